@@ -1,27 +1,77 @@
 #![allow(dead_code)]
 extern crate clap;
+extern crate serde_json;
 
-use helper::Log;
+use helper::{Log, NetHelper};
+use network::{Connection, ParentLossPolicy};
 
-use self::clap::{Arg, App};
+use self::clap::{Arg, App, ArgMatches};
+use self::serde_json::Value;
 
 use std::process;
-use std::error::Error;
+use std::fmt;
+use std::fs::File;
+use std::io::Read;
+use std::collections::BTreeMap;
+use std::net::SocketAddr;
+use std::str::FromStr;
+use std::time::Duration;
 
 pub const APP_VERSION: &'static str = "1.0.34";
 pub const MAX_API_VERSION: u32 = 1000;
 
+/// Keys accepted from configuration file, they are the same as command line argument names
+/// so file values are parsed exactly like command line values
+const CONFIG_FILE_KEYS: &'static [&'static str] = &["token", "value", "api", "parent", "concurrency", "tcp_host",
+                                                     "proxy", "proxy_auth", "linger", "api_linger", "dedup_size", "dedup_ttl", "slow_callback", "callback_watchdog",
+                                                     "handshake_failures", "handshake_window", "handshake_cooldown",
+                                                     "max_connections", "max_api_connections", "parent_loss_policy", "manifest", "bind_retry", "mirror", "close_timeout",
+                                                     "read_timeout", "write_timeout", "connect_timeout",
+                                                     "read_rate", "write_rate", "api_read_rate", "api_write_rate"];
+
+/// Boolean keys accepted from configuration file, same as command line flags
+const CONFIG_FILE_FLAGS: &'static [&'static str] = &["event_metrics", "allow_raw_tokens", "trim_tokens", "close_on_decode_failure"];
+
 pub struct NodeConfig {
     pub value: u64,
     pub token: String,
     pub api_version: u32,
     pub network: NetworkingConfig,
-    pub parent_address: String
+    pub parent_address: String,
+    pub event_metrics: bool,
+    pub dedup_size: usize,
+    pub dedup_ttl: Duration,
+    pub slow_callback: Option<Duration>,
+    pub callback_watchdog: Option<Duration>
 }
 
 pub struct NetworkingConfig {
     pub tcp_server_host: String,
-    pub concurrency: usize
+    pub concurrency: usize,
+    pub proxy_address: String,
+    pub proxy_auth: String,
+    pub allow_raw_tokens: bool,
+    pub trim_tokens: bool,
+    pub close_on_decode_failure: bool,
+    pub linger: Option<Duration>,
+    pub api_linger: Option<Duration>,
+    pub close_timeout: Duration,
+    pub read_timeout: Option<Duration>,
+    pub write_timeout: Option<Duration>,
+    pub connect_timeout: Option<Duration>,
+    pub read_rate: Option<u64>,
+    pub write_rate: Option<u64>,
+    pub api_read_rate: Option<u64>,
+    pub api_write_rate: Option<u64>,
+    pub handshake_failures: usize,
+    pub handshake_window: Duration,
+    pub handshake_cooldown: Duration,
+    pub max_connections: usize,
+    pub max_api_connections: usize,
+    pub parent_loss_policy: ParentLossPolicy,
+    pub manifest_path: String,
+    pub bind_retry: Duration,
+    pub mirror_token: String
 }
 
 pub fn parse_args() -> NodeConfig {
@@ -29,6 +79,11 @@ pub fn parse_args() -> NodeConfig {
                     .version(APP_VERSION)
                     .author("TreeScale Inc. <hello@treescale.com>")
                     .about("TreeScale technology endpoint for event distribution and data transfer")
+                    .arg(Arg::with_name("config")
+                            .long("config")
+                            .value_name("CONFIG_FILE")
+                            .help("Reads configuration from given JSON file, command line arguments are overriding file values, flags could be turned off with their --no- variants")
+                            .takes_value(true))
                     .arg(Arg::with_name("token")
                             .short("t")
                             .long("token")
@@ -64,56 +119,611 @@ pub fn parse_args() -> NodeConfig {
                             .value_name("TCP_SERVER_HOST")
                             .help("Starts TCP server listener on give host: default is 0.0.0.0:8000")
                             .takes_value(true))
+                    .arg(Arg::with_name("bind_retry")
+                            .long("bind-retry")
+                            .value_name("SECONDS")
+                            .help("Retries binding TCP server address while it's in use during given time, default is 0 which fails immediately")
+                            .takes_value(true))
+                    .arg(Arg::with_name("proxy")
+                            .long("proxy")
+                            .value_name("SOCKS5_PROXY_ADDRESS")
+                            .help("Makes parent connection through given SOCKS5 proxy server, default is direct connection")
+                            .takes_value(true))
+                    .arg(Arg::with_name("proxy_auth")
+                            .long("proxy-auth")
+                            .value_name("USER:PASSWORD")
+                            .help("Credentials for SOCKS5 proxy server username/password authentication")
+                            .takes_value(true))
+                    .arg(Arg::with_name("linger")
+                            .long("linger")
+                            .value_name("SECONDS")
+                            .help("Sets SO_LINGER timeout for Node connections, default is system behaviour")
+                            .takes_value(true))
+                    .arg(Arg::with_name("api_linger")
+                            .long("api-linger")
+                            .value_name("SECONDS")
+                            .help("Sets SO_LINGER timeout for API connections, default is system behaviour")
+                            .takes_value(true))
+                    .arg(Arg::with_name("close_timeout")
+                            .long("close-timeout")
+                            .value_name("SECONDS")
+                            .help("Closes connection anyway if it didn't flush remaining data during given time after close request, default is 5 seconds")
+                            .takes_value(true))
+                    .arg(Arg::with_name("read_timeout")
+                            .long("read-timeout")
+                            .value_name("SECONDS")
+                            .help("Closes connection if nothing was read from it during given time, default is 0 which disables it")
+                            .takes_value(true))
+                    .arg(Arg::with_name("write_timeout")
+                            .long("write-timeout")
+                            .value_name("SECONDS")
+                            .help("Closes connection if queued data was not written to it during given time, default is 0 which disables it")
+                            .takes_value(true))
+                    .arg(Arg::with_name("connect_timeout")
+                            .long("connect-timeout")
+                            .value_name("SECONDS")
+                            .help("Gives up connecting to parent if proxy and API handshakes are not done during given time, default is 0 which disables it")
+                            .takes_value(true))
+                    .arg(Arg::with_name("read_rate")
+                            .long("read-rate")
+                            .value_name("BYTES_PER_SECOND")
+                            .help("Limits reading from each Node connection, default is 0 which means unlimited")
+                            .takes_value(true))
+                    .arg(Arg::with_name("write_rate")
+                            .long("write-rate")
+                            .value_name("BYTES_PER_SECOND")
+                            .help("Limits writing to each Node connection, default is 0 which means unlimited")
+                            .takes_value(true))
+                    .arg(Arg::with_name("api_read_rate")
+                            .long("api-read-rate")
+                            .value_name("BYTES_PER_SECOND")
+                            .help("Limits reading from each API connection, default is 0 which means unlimited")
+                            .takes_value(true))
+                    .arg(Arg::with_name("api_write_rate")
+                            .long("api-write-rate")
+                            .value_name("BYTES_PER_SECOND")
+                            .help("Limits writing to each API connection, default is 0 which means unlimited")
+                            .takes_value(true))
+                    .arg(Arg::with_name("handshake_failures")
+                            .long("handshake-failures")
+                            .value_name("FAILURES_COUNT")
+                            .help("Blocks IP after given count of failed handshakes, default is 0 which disables it")
+                            .takes_value(true))
+                    .arg(Arg::with_name("handshake_window")
+                            .long("handshake-window")
+                            .value_name("SECONDS")
+                            .help("Time window for counting failed handshakes from one IP, default is 60 seconds")
+                            .takes_value(true))
+                    .arg(Arg::with_name("handshake_cooldown")
+                            .long("handshake-cooldown")
+                            .value_name("SECONDS")
+                            .help("How long connections from blocked IP are rejected, default is 300 seconds")
+                            .takes_value(true))
+                    .arg(Arg::with_name("max_connections")
+                            .long("max-connections")
+                            .value_name("CONNECTIONS_COUNT")
+                            .help("Rejects new child Node connections after given count, default is 0 which means unlimited")
+                            .takes_value(true))
+                    .arg(Arg::with_name("max_api_connections")
+                            .long("max-api-connections")
+                            .value_name("CONNECTIONS_COUNT")
+                            .help("Rejects new API connections after given count, default is 0 which means unlimited")
+                            .takes_value(true))
+                    .arg(Arg::with_name("parent_loss_policy")
+                            .long("parent-loss-policy")
+                            .value_name("keep|notify|disconnect")
+                            .help("What to do with API connections when parent connection is lost, default is keep, which buffers events for parent until it's connected again")
+                            .takes_value(true))
+                    .arg(Arg::with_name("manifest")
+                            .long("manifest")
+                            .value_name("MANIFEST_FILE")
+                            .help("Accepts only Node connections listed in given JSON topology manifest file")
+                            .takes_value(true))
+                    .arg(Arg::with_name("mirror")
+                            .long("mirror")
+                            .value_name("STANDBY_TOKEN")
+                            .help("Sends copy of every received event to connection with given token, for keeping hot standby Node")
+                            .takes_value(true))
+                    .arg(Arg::with_name("event_metrics")
+                            .long("event-metrics")
+                            .help("Records trigger counts and callback durations for each event"))
+                    .arg(Arg::with_name("dedup_size")
+                            .long("dedup-size")
+                            .value_name("EVENTS_COUNT")
+                            .help("Keeps IDs of given count of recent events for dropping duplicates, default is 0 which disables it")
+                            .takes_value(true))
+                    .arg(Arg::with_name("dedup_ttl")
+                            .long("dedup-ttl")
+                            .value_name("SECONDS")
+                            .help("How long to keep recent event IDs for dropping duplicates, default is 60 seconds")
+                            .takes_value(true))
+                    .arg(Arg::with_name("slow_callback")
+                            .long("slow-callback")
+                            .value_name("MILLISECONDS")
+                            .help("Logs event callbacks running longer than given time, default is disabled")
+                            .takes_value(true))
+                    .arg(Arg::with_name("callback_watchdog")
+                            .long("callback-watchdog")
+                            .value_name("SECONDS")
+                            .help("Logs event callback which is still running after given time while it's blocking Node, 0 disables it, default is disabled")
+                            .takes_value(true))
+                    .arg(Arg::with_name("allow_raw_tokens")
+                            .long("allow-raw-tokens")
+                            .help("Accepts connection tokens with control characters, by default only printable tokens are accepted, tokens should be valid UTF-8 anyway"))
+                    .arg(Arg::with_name("close_on_decode_failure")
+                            .long("close-on-decode-failure")
+                            .help("Closes connection which sent data that can't be decoded as event, by default that data is skipped"))
+                    .arg(Arg::with_name("trim_tokens")
+                            .long("trim-tokens")
+                            .help("Removes trailing whitespaces and zero bytes from connection tokens, by default padded tokens are rejected"))
+                    .arg(Arg::with_name("no_event_metrics")
+                            .long("no-event-metrics")
+                            .conflicts_with("event_metrics")
+                            .help("Disables event metrics enabled in configuration file"))
+                    .arg(Arg::with_name("no_allow_raw_tokens")
+                            .long("no-allow-raw-tokens")
+                            .conflicts_with("allow_raw_tokens")
+                            .help("Disables raw tokens allowed in configuration file"))
+                    .arg(Arg::with_name("no_close_on_decode_failure")
+                            .long("no-close-on-decode-failure")
+                            .conflicts_with("close_on_decode_failure")
+                            .help("Disables closing connections on decode failure enabled in configuration file"))
+                    .arg(Arg::with_name("no_trim_tokens")
+                            .long("no-trim-tokens")
+                            .conflicts_with("trim_tokens")
+                            .help("Disables tokens trimming enabled in configuration file"))
         .get_matches();
 
-    NodeConfig {
-        value: match matches.value_of("value") {
-            Some(v) => match String::from(v).parse::<u64>() {
-                Ok(vv) => vv,
-                Err(e) => {
-                    Log::error("Unable to parse given Node Value", e.description());
-                    process::exit(1);
+    let file_config = match matches.value_of("config") {
+        Some(path) => match load_config(path) {
+            Ok(c) => c,
+            Err(problems) => {
+                for problem in &problems {
+                    Log::error("Invalid configuration file", problem.as_str());
                 }
-            },
-            None => 0
+                process::exit(1);
+            }
         },
+        None => BTreeMap::new()
+    };
+
+    let config = match NodeConfig::from_values(&merge_values(file_config, args_values(&matches))) {
+        Ok(c) => c,
+        Err(problems) => {
+            for problem in &problems {
+                Log::error("Invalid configuration", problem.as_str());
+            }
+            process::exit(1);
+        }
+    };
+
+    // reporting all configuration problems at once
+    // before starting any networking
+    match config.validate() {
+        Ok(_) => {}
+        Err(problems) => {
+            for problem in &problems {
+                Log::error("Invalid configuration", problem.as_str());
+            }
+            process::exit(1);
+        }
+    }
+
+    config
+}
 
-        token: match matches.value_of("token") {
-            Some(v) => String::from(v),
-            None => String::new()
+/// Getting values given in command line, with the same keys as configuration file
+/// flags are "true" if they are set and "false" if their "--no-" variant is set
+fn args_values(matches: &ArgMatches) -> BTreeMap<String, String> {
+    let mut values: BTreeMap<String, String> = BTreeMap::new();
+    for name in CONFIG_FILE_KEYS {
+        if let Some(v) = matches.value_of(name) {
+            values.insert(String::from(*name), String::from(v));
+        }
+    }
+
+    for name in CONFIG_FILE_FLAGS {
+        if matches.is_present(name) {
+            values.insert(String::from(*name), String::from("true"));
+        } else if matches.is_present(format!("no_{}", name)) {
+            values.insert(String::from(*name), String::from("false"));
+        }
+    }
+
+    values
+}
+
+/// Merging configuration file values with command line values
+/// command line values are overriding file values, including flags
+#[inline(always)]
+fn merge_values(file_values: BTreeMap<String, String>, args: BTreeMap<String, String>) -> BTreeMap<String, String> {
+    let mut values = file_values;
+    values.extend(args);
+    values
+}
+
+/// Parsing value with given name if it's set
+/// adding problem to the list if it can't be parsed
+fn parse_value<T: FromStr>(values: &BTreeMap<String, String>, name: &str, title: &str, problems: &mut Vec<String>) -> Option<T>
+    where T::Err: fmt::Display {
+    match values.get(name) {
+        Some(v) => match v.parse::<T>() {
+            Ok(vv) => Some(vv),
+            Err(e) => {
+                problems.push(format!("Unable to parse given {} \"{}\" -> {}", title, v, e));
+                None
+            }
         },
+        None => None
+    }
+}
+
+/// Making timeout from seconds, where 0 is disabling it
+fn enabled_secs(secs: u64) -> Option<Duration> {
+    if secs == 0 { None } else { Some(Duration::from_secs(secs)) }
+}
+
+/// Making bytes per second limit, where 0 is unlimited
+fn enabled_rate(rate: u64) -> Option<u64> {
+    if rate == 0 { None } else { Some(rate) }
+}
 
-        api_version: match matches.value_of("api") {
-            Some(v) => match String::from(v).parse::<u32>() {
-                Ok(vv) => vv,
-                Err(e) => {
-                    Log::error("Unable to parse given API Version", e.description());
-                    process::exit(1);
+/// Loading configuration from JSON file
+/// File should contain single object with keys same as command line argument names
+/// Returns values as strings for parsing them same way as command line arguments
+/// or list of all found problems, including unknown fields
+pub fn load_config(path: &str) -> Result<BTreeMap<String, String>, Vec<String>> {
+    let mut content = String::new();
+    match File::open(path) {
+        Ok(mut f) => {
+            if let Err(e) = f.read_to_string(&mut content) {
+                return Err(vec![format!("Unable to read configuration file \"{}\" -> {}", path, e)]);
+            }
+        }
+        Err(e) => return Err(vec![format!("Unable to open configuration file \"{}\" -> {}", path, e)])
+    }
+
+    let json: Value = match serde_json::from_str(content.as_str()) {
+        Ok(v) => v,
+        Err(e) => return Err(vec![format!("Unable to parse configuration file \"{}\" -> {}", path, e)])
+    };
+
+    let fields = match json.as_object() {
+        Some(o) => o,
+        None => return Err(vec![format!("Configuration file \"{}\" should contain JSON object", path)])
+    };
+
+    let mut config: BTreeMap<String, String> = BTreeMap::new();
+    let mut problems: Vec<String> = vec![];
+    for (key, value) in fields {
+        let is_flag = CONFIG_FILE_FLAGS.contains(&key.as_str());
+        if !is_flag && !CONFIG_FILE_KEYS.contains(&key.as_str()) {
+            problems.push(format!("Unknown configuration field \"{}\"", key));
+            continue;
+        }
+
+        match *value {
+            Value::Bool(b) if is_flag => {
+                config.insert(key.clone(), b.to_string());
+            }
+            Value::String(ref s) if !is_flag => {
+                config.insert(key.clone(), s.clone());
+            }
+            Value::Number(ref n) if !is_flag => {
+                config.insert(key.clone(), n.to_string());
+            }
+            _ => {
+                if is_flag {
+                    problems.push(format!("Configuration field \"{}\" should be a boolean", key));
+                } else {
+                    problems.push(format!("Configuration field \"{}\" should be a string or number", key));
                 }
-            },
-            None => 1
-        },
+            }
+        }
+    }
 
-        network: NetworkingConfig {
-            tcp_server_host: match matches.value_of("tcp_host") {
-                Some(v) => String::from(v),
-                None => String::from("0.0.0.0:8000")
-            },
-            concurrency: match matches.value_of("concurrency") {
-                Some(v) => match String::from(v).parse::<usize>() {
-                    Ok(vv) => vv,
-                    Err(e) => {
-                        Log::error("Unable to parse given Concurrency Level parameter", e.description());
-                        process::exit(1);
-                    }
-                },
-                None => 0
+    if problems.len() > 0 {
+        return Err(problems);
+    }
+
+    Ok(config)
+}
+
+impl NodeConfig {
+    /// Making configuration from values with command line argument names as keys
+    /// flags are set by "true" value, missing keys are getting default values
+    /// Returns list of all values which couldn't be parsed
+    pub fn from_values(values: &BTreeMap<String, String>) -> Result<NodeConfig, Vec<String>> {
+        let mut problems: Vec<String> = vec![];
+        let string_of = |name: &str| values.get(name).cloned().unwrap_or(String::new());
+        let flag_of = |name: &str| values.get(name).map_or(false, |v| v == "true");
+
+        let parent_loss_policy = match values.get("parent_loss_policy").map(|v| v.as_str()) {
+            Some("keep") | None => ParentLossPolicy::Keep,
+            Some("notify") => ParentLossPolicy::Notify,
+            Some("disconnect") => ParentLossPolicy::Disconnect,
+            Some(v) => {
+                problems.push(format!("Unable to parse given Parent Loss Policy \"{}\" -> It should be one of keep, notify or disconnect", v));
+                ParentLossPolicy::Keep
+            }
+        };
+
+        let config = NodeConfig {
+            value: parse_value(values, "value", "Node Value", &mut problems).unwrap_or(0),
+            token: string_of("token"),
+            api_version: parse_value(values, "api", "API Version", &mut problems).unwrap_or(0),
+            network: NetworkingConfig {
+                tcp_server_host: values.get("tcp_host").cloned().unwrap_or(String::from("0.0.0.0:8000")),
+                concurrency: parse_value(values, "concurrency", "Concurrency Level parameter", &mut problems).unwrap_or(0),
+                proxy_address: string_of("proxy"),
+                proxy_auth: string_of("proxy_auth"),
+                allow_raw_tokens: flag_of("allow_raw_tokens"),
+                trim_tokens: flag_of("trim_tokens"),
+                close_on_decode_failure: flag_of("close_on_decode_failure"),
+                linger: parse_value(values, "linger", "Linger timeout", &mut problems).map(Duration::from_secs),
+                api_linger: parse_value(values, "api_linger", "API Linger timeout", &mut problems).map(Duration::from_secs),
+                close_timeout: Duration::from_secs(parse_value(values, "close_timeout", "Close timeout", &mut problems).unwrap_or(5)),
+                read_timeout: parse_value(values, "read_timeout", "Read timeout", &mut problems).and_then(enabled_secs),
+                write_timeout: parse_value(values, "write_timeout", "Write timeout", &mut problems).and_then(enabled_secs),
+                connect_timeout: parse_value(values, "connect_timeout", "Connect timeout", &mut problems).and_then(enabled_secs),
+                read_rate: parse_value(values, "read_rate", "Read rate", &mut problems).and_then(enabled_rate),
+                write_rate: parse_value(values, "write_rate", "Write rate", &mut problems).and_then(enabled_rate),
+                api_read_rate: parse_value(values, "api_read_rate", "API Read rate", &mut problems).and_then(enabled_rate),
+                api_write_rate: parse_value(values, "api_write_rate", "API Write rate", &mut problems).and_then(enabled_rate),
+                handshake_failures: parse_value(values, "handshake_failures", "Handshake Failures count", &mut problems).unwrap_or(0),
+                handshake_window: Duration::from_secs(parse_value(values, "handshake_window", "Handshake Window", &mut problems).unwrap_or(60)),
+                handshake_cooldown: Duration::from_secs(parse_value(values, "handshake_cooldown", "Handshake Cooldown", &mut problems).unwrap_or(300)),
+                max_connections: parse_value(values, "max_connections", "Max Connections count", &mut problems).unwrap_or(0),
+                max_api_connections: parse_value(values, "max_api_connections", "Max API Connections count", &mut problems).unwrap_or(0),
+                parent_loss_policy: parent_loss_policy,
+                manifest_path: string_of("manifest"),
+                bind_retry: Duration::from_secs(parse_value(values, "bind_retry", "Bind Retry time", &mut problems).unwrap_or(0)),
+                mirror_token: string_of("mirror")
             },
-        },
+            parent_address: string_of("parent"),
+            event_metrics: flag_of("event_metrics"),
+            dedup_size: parse_value(values, "dedup_size", "Dedup Size", &mut problems).unwrap_or(0),
+            dedup_ttl: Duration::from_secs(parse_value(values, "dedup_ttl", "Dedup TTL", &mut problems).unwrap_or(60)),
+            slow_callback: parse_value(values, "slow_callback", "Slow Callback time", &mut problems).map(Duration::from_millis),
+            callback_watchdog: parse_value(values, "callback_watchdog", "Callback Watchdog time", &mut problems).and_then(enabled_secs)
+        };
 
-        parent_address: match matches.value_of("parent") {
-            Some(v) => String::from(v),
-            None => String::new()
-        },
+        if problems.len() > 0 {
+            return Err(problems);
+        }
+
+        Ok(config)
+    }
+
+    /// Checking all configuration fields
+    /// Returns list of all found problems if configuration is invalid
+    pub fn validate(&self) -> Result<(), Vec<String>> {
+        let mut problems: Vec<String> = vec![];
+
+        if !NetHelper::validate_value(self.value) {
+            problems.push(format!("Node value {} should be a Prime Number", self.value));
+        }
+
+        if self.token.len() > 0 && !NetHelper::validate_token(self.token.as_str(), self.network.allow_raw_tokens) {
+            problems.push(format!("Node token \"{}\" should contain only printable characters"
+                                  , NetHelper::escape_token(self.token.as_str())));
+        }
+
+        if self.api_version != 0 && !Connection::check_api_version(self.api_version, 0) {
+            problems.push(format!("API version {} should be between 1 and {}", self.api_version, MAX_API_VERSION - 1));
+        }
+
+        if let Err(e) = SocketAddr::from_str(self.network.tcp_server_host.as_str()) {
+            problems.push(format!("TCP server host \"{}\" is not a valid address -> {}", self.network.tcp_server_host, e));
+        }
+
+        if self.parent_address.len() > 0 {
+            if let Err(e) = SocketAddr::from_str(self.parent_address.as_str()) {
+                problems.push(format!("Parent address \"{}\" is not a valid address -> {}", self.parent_address, e));
+            }
+        }
+
+        if self.network.proxy_address.len() > 0 {
+            if let Err(e) = SocketAddr::from_str(self.network.proxy_address.as_str()) {
+                problems.push(format!("SOCKS5 proxy address \"{}\" is not a valid address -> {}", self.network.proxy_address, e));
+            }
+        }
+
+        if self.network.proxy_auth.len() > 0 {
+            if self.network.proxy_address.len() == 0 {
+                problems.push(String::from("SOCKS5 proxy credentials are set without proxy address"));
+            }
+
+            if self.network.proxy_auth.find(':').is_none() {
+                problems.push(String::from("SOCKS5 proxy credentials should be in USER:PASSWORD format"));
+            }
+        }
+
+        if problems.len() > 0 {
+            return Err(problems);
+        }
+
+        Ok(())
+    }
+}
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::Write;
+
+    fn valid_config() -> NodeConfig {
+        let mut values = BTreeMap::new();
+        values.insert(String::from("token"), String::from("node"));
+        NodeConfig::from_values(&values).unwrap()
+    }
+
+    #[test]
+    fn valid_configuration() {
+        assert!(valid_config().validate().is_ok());
+    }
+
+    #[test]
+    fn all_problems_reported() {
+        let mut config = valid_config();
+        config.value = 9;
+        config.token = String::from("bad\ntoken");
+        config.api_version = MAX_API_VERSION;
+        config.network.tcp_server_host = String::from("localhost");
+        config.parent_address = String::from("parent");
+        config.network.proxy_auth = String::from("user");
+
+        let problems = config.validate().unwrap_err();
+        // proxy credentials are wrong twice, without address and without ':'
+        assert_eq!(problems.len(), 7);
+        assert!(problems[0].contains("Prime"));
+        assert!(problems[1].contains("bad\\ntoken"));
+    }
+
+    fn config_file(name: &str, content: &str) -> String {
+        let path = ::std::env::temp_dir().join(format!("treescale-config-{}-{}.json", name, process::id()));
+        File::create(&path).unwrap().write_all(content.as_bytes()).unwrap();
+        String::from(path.to_str().unwrap())
+    }
+
+    #[test]
+    fn load_values() {
+        let path = config_file("values", r#"{"token": "node", "value": 3, "event_metrics": true, "trim_tokens": false}"#);
+        let config = load_config(path.as_str()).unwrap();
+        assert_eq!(config.get("token").map(|v| v.as_str()), Some("node"));
+        assert_eq!(config.get("value").map(|v| v.as_str()), Some("3"));
+        assert_eq!(config.get("event_metrics").map(|v| v.as_str()), Some("true"));
+        assert_eq!(config.get("trim_tokens").map(|v| v.as_str()), Some("false"));
+    }
+
+    #[test]
+    fn load_reports_all_problems() {
+        let path = config_file("problems", r#"{"tokn": "node", "value": [3], "event_metrics": "yes", "parent": "127.0.0.1:8000"}"#);
+        let problems = load_config(path.as_str()).unwrap_err();
+        assert_eq!(problems.len(), 3);
+        assert!(problems.iter().any(|p| p.contains("Unknown configuration field \"tokn\"")));
+        assert!(problems.iter().any(|p| p.contains("\"value\" should be a string or number")));
+        assert!(problems.iter().any(|p| p.contains("\"event_metrics\" should be a boolean")));
+    }
+
+    #[test]
+    fn load_invalid_file() {
+        assert_eq!(load_config(config_file("array", "[1, 2]").as_str()).unwrap_err().len(), 1);
+        assert_eq!(load_config(config_file("broken", "{\"token\": ").as_str()).unwrap_err().len(), 1);
+        assert_eq!(load_config("/nonexistent/treescale.json").unwrap_err().len(), 1);
+    }
+
+    fn values(pairs: &[(&str, &str)]) -> BTreeMap<String, String> {
+        pairs.iter().map(|&(k, v)| (String::from(k), String::from(v))).collect()
+    }
+
+    #[test]
+    fn default_values() {
+        let config = NodeConfig::from_values(&BTreeMap::new()).unwrap();
+        assert_eq!(config.value, 0);
+        assert_eq!(config.token, "");
+        assert_eq!(config.api_version, 0);
+        assert_eq!(config.network.tcp_server_host, "0.0.0.0:8000");
+        assert_eq!(config.network.close_timeout, Duration::from_secs(5));
+        assert_eq!(config.network.handshake_window, Duration::from_secs(60));
+        assert_eq!(config.network.handshake_cooldown, Duration::from_secs(300));
+        assert!(config.network.linger.is_none());
+        assert!(config.network.read_timeout.is_none() && config.network.write_timeout.is_none());
+        assert!(config.network.parent_loss_policy == ParentLossPolicy::Keep);
+        assert_eq!(config.dedup_ttl, Duration::from_secs(60));
+        assert!(config.slow_callback.is_none() && config.callback_watchdog.is_none());
+        assert!(!config.event_metrics && !config.network.trim_tokens);
+    }
+
+    #[test]
+    fn every_key_maps() {
+        let all = values(&[("token", "node"), ("value", "7"), ("api", "3"), ("parent", "127.0.0.1:8001"),
+                           ("concurrency", "2"), ("tcp_host", "127.0.0.1:8002"), ("proxy", "127.0.0.1:1080"),
+                           ("proxy_auth", "user:pass"), ("linger", "4"), ("api_linger", "6"), ("dedup_size", "100"),
+                           ("dedup_ttl", "30"), ("slow_callback", "250"), ("callback_watchdog", "15"),
+                           ("handshake_failures", "5"), ("handshake_window", "20"), ("handshake_cooldown", "40"), ("max_connections", "8"),
+                           ("max_api_connections", "9"), ("parent_loss_policy", "disconnect"), ("manifest", "/etc/m.json"),
+                           ("bind_retry", "11"), ("mirror", "standby"), ("close_timeout", "12"),
+                           ("read_timeout", "13"), ("write_timeout", "0"), ("connect_timeout", "14"),
+                           ("read_rate", "1000"), ("write_rate", "2000"), ("api_read_rate", "0"), ("api_write_rate", "4000"),
+                           ("event_metrics", "true"), ("allow_raw_tokens", "true"), ("trim_tokens", "true"),
+                           ("close_on_decode_failure", "true")]);
+
+        // new keys should be added here too
+        for key in CONFIG_FILE_KEYS.iter().chain(CONFIG_FILE_FLAGS.iter()) {
+            assert!(all.contains_key(*key), "{} is not checked", key);
+        }
+        assert_eq!(all.len(), CONFIG_FILE_KEYS.len() + CONFIG_FILE_FLAGS.len());
+
+        let config = NodeConfig::from_values(&all).unwrap();
+        assert_eq!(config.token, "node");
+        assert_eq!(config.value, 7);
+        assert_eq!(config.api_version, 3);
+        assert_eq!(config.parent_address, "127.0.0.1:8001");
+        assert_eq!(config.network.concurrency, 2);
+        assert_eq!(config.network.tcp_server_host, "127.0.0.1:8002");
+        assert_eq!(config.network.proxy_address, "127.0.0.1:1080");
+        assert_eq!(config.network.proxy_auth, "user:pass");
+        assert_eq!(config.network.linger, Some(Duration::from_secs(4)));
+        assert_eq!(config.network.api_linger, Some(Duration::from_secs(6)));
+        assert_eq!(config.dedup_size, 100);
+        assert_eq!(config.dedup_ttl, Duration::from_secs(30));
+        assert_eq!(config.slow_callback, Some(Duration::from_millis(250)));
+        assert_eq!(config.callback_watchdog, Some(Duration::from_secs(15)));
+        assert_eq!(config.network.handshake_failures, 5);
+        assert_eq!(config.network.handshake_window, Duration::from_secs(20));
+        assert_eq!(config.network.handshake_cooldown, Duration::from_secs(40));
+        assert_eq!(config.network.max_connections, 8);
+        assert_eq!(config.network.max_api_connections, 9);
+        assert!(config.network.parent_loss_policy == ParentLossPolicy::Disconnect);
+        assert_eq!(config.network.manifest_path, "/etc/m.json");
+        assert_eq!(config.network.bind_retry, Duration::from_secs(11));
+        assert_eq!(config.network.mirror_token, "standby");
+        assert_eq!(config.network.close_timeout, Duration::from_secs(12));
+        assert_eq!(config.network.read_timeout, Some(Duration::from_secs(13)));
+        // zero is disabling timeout
+        assert!(config.network.write_timeout.is_none());
+        assert_eq!(config.network.connect_timeout, Some(Duration::from_secs(14)));
+        assert_eq!(config.network.read_rate, Some(1000));
+        assert_eq!(config.network.write_rate, Some(2000));
+        assert_eq!(config.network.api_read_rate, None);
+        assert_eq!(config.network.api_write_rate, Some(4000));
+        assert!(config.event_metrics);
+        assert!(config.network.allow_raw_tokens);
+        assert!(config.network.trim_tokens);
+        assert!(config.network.close_on_decode_failure);
+    }
+
+    #[test]
+    fn parse_problems_reported() {
+        let problems = match NodeConfig::from_values(&values(&[("value", "x"), ("linger", "-1"), ("parent_loss_policy", "drop")])) {
+            Ok(_) => panic!("invalid values are accepted"),
+            Err(problems) => problems
+        };
+        assert_eq!(problems.len(), 3);
+        assert!(problems.iter().any(|p| p.contains("Node Value \"x\"")));
+        assert!(problems.iter().any(|p| p.contains("Linger timeout \"-1\"")));
+        assert!(problems.iter().any(|p| p.contains("Parent Loss Policy \"drop\"")));
+    }
+
+    #[test]
+    fn file_values_map_to_config() {
+        let path = config_file("mapping", r#"{"value": 5, "max_connections": 3, "parent_loss_policy": "notify", "trim_tokens": true}"#);
+        let config = NodeConfig::from_values(&load_config(path.as_str()).unwrap()).unwrap();
+        assert_eq!(config.value, 5);
+        assert_eq!(config.network.max_connections, 3);
+        assert!(config.network.parent_loss_policy == ParentLossPolicy::Notify);
+        assert!(config.network.trim_tokens);
+    }
+
+    #[test]
+    fn command_line_overrides_file() {
+        let file = values(&[("token", "file"), ("value", "3"), ("trim_tokens", "true"), ("event_metrics", "true")]);
+        let args = values(&[("token", "args"), ("trim_tokens", "false")]);
+        let config = NodeConfig::from_values(&merge_values(file, args)).unwrap();
+        assert_eq!(config.token, "args");
+        assert_eq!(config.value, 3);
+        // "--no-trim-tokens" is turning off flag set in file
+        assert!(!config.network.trim_tokens);
+        assert!(config.event_metrics);
     }
 }
\ No newline at end of file
@@ -0,0 +1,91 @@
+#![allow(dead_code)]
+
+use event::Event;
+
+/// Codec for converting events to bytes and back
+/// Connections are framing data with 4 bytes BigEndian length themselves,
+/// so codec is only defining format of the single event chunk, in both directions
+/// This framing is part of API version 2, API version 1 Nodes are not able to read it
+/// All nodes of the same network should use the same codec
+pub trait EventCodec: Send + Sync {
+    /// Converting event to bytes, None if event can't be encoded
+    fn encode(&self, event: &Event) -> Option<Vec<u8>>;
+
+    /// Converting received bytes to event, None if data is invalid
+    fn decode(&self, data: &Vec<u8>) -> Option<Event>;
+}
+
+/// Default codec using Event raw binary format
+pub struct RawEventCodec;
+
+impl EventCodec for RawEventCodec {
+    #[inline(always)]
+    fn encode(&self, event: &Event) -> Option<Vec<u8>> {
+        event.to_raw()
+    }
+
+    #[inline(always)]
+    fn decode(&self, data: &Vec<u8>) -> Option<Event> {
+        Event::from_raw(data)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Alternate codec which is keeping only name and data
+    struct NameDataCodec;
+
+    impl EventCodec for NameDataCodec {
+        fn encode(&self, event: &Event) -> Option<Vec<u8>> {
+            let mut data = vec![event.name.len() as u8];
+            data.extend_from_slice(event.name.as_bytes());
+            data.extend_from_slice(event.data.as_slice());
+            Some(data)
+        }
+
+        fn decode(&self, data: &Vec<u8>) -> Option<Event> {
+            let name_len = match data.first() {
+                Some(l) => *l as usize,
+                None => return None
+            };
+
+            if data.len() < 1 + name_len {
+                return None;
+            }
+
+            let mut ev = Event::default();
+            ev.name = match String::from_utf8(Vec::from(&data[1..1 + name_len])) {
+                Ok(n) => n,
+                Err(_) => return None
+            };
+            ev.data = Vec::from(&data[1 + name_len..]);
+            Some(ev)
+        }
+    }
+
+    fn round_trip(codec: &EventCodec) -> Event {
+        let mut ev = Event::default();
+        ev.name = String::from("update");
+        ev.data = vec![1, 2, 3];
+
+        // encoded data is decoded as is, without any framing
+        codec.decode(&codec.encode(&ev).unwrap()).unwrap()
+    }
+
+    #[test]
+    fn raw_codec() {
+        let ev = round_trip(&RawEventCodec);
+        assert_eq!(ev.name, "update");
+        assert_eq!(ev.data, vec![1, 2, 3]);
+    }
+
+    #[test]
+    fn alternate_codec() {
+        let ev = round_trip(&NameDataCodec);
+        assert_eq!(ev.name, "update");
+        assert_eq!(ev.data, vec![1, 2, 3]);
+        assert!(NameDataCodec.decode(&vec![10, b'a']).is_none());
+    }
+}
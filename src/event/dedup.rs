@@ -0,0 +1,163 @@
+#![allow(dead_code)]
+
+use helper::{Clock, SystemClock};
+
+use std::collections::{BTreeSet, VecDeque};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+/// Cache of recently received event IDs for dropping duplicate events
+/// Entries are removed when they are older than "ttl"
+/// or when cache is bigger than "max_size"
+pub struct EventDedup {
+    // (from token, event id) combinations which we already got
+    ids: BTreeSet<(String, u64)>,
+
+    // same combinations in receive order, for expiring them
+    order: VecDeque<((String, u64), Instant)>,
+
+    max_size: usize,
+    ttl: Duration,
+    clock: Arc<Clock>,
+
+    // how many duplicates we have dropped
+    pub duplicates: u64
+}
+
+impl EventDedup {
+    pub fn new(max_size: usize, ttl: Duration) -> EventDedup {
+        EventDedup::with_clock(max_size, ttl, Arc::new(SystemClock))
+    }
+
+    /// Making cache which is using given clock for expiring entries
+    pub fn with_clock(max_size: usize, ttl: Duration, clock: Arc<Clock>) -> EventDedup {
+        EventDedup {
+            ids: BTreeSet::new(),
+            order: VecDeque::with_capacity(max_size),
+            max_size: max_size,
+            ttl: ttl,
+            clock: clock,
+            duplicates: 0
+        }
+    }
+
+    /// Checking if we got this event for the first time
+    /// Returns false if this is a duplicate event
+    /// Events without ID are always accepted
+    pub fn check(&mut self, from: &String, id: u64) -> bool {
+        if id == 0 || self.max_size == 0 {
+            return true;
+        }
+
+        let now = self.clock.now();
+        self.expire(now);
+
+        let key = (from.clone(), id);
+        if self.ids.contains(&key) {
+            self.duplicates += 1;
+            return false;
+        }
+
+        // keeping cache size limited
+        if self.order.len() >= self.max_size {
+            match self.order.pop_front() {
+                Some((k, _)) => {
+                    self.ids.remove(&k);
+                }
+                None => {}
+            }
+        }
+
+        self.ids.insert(key.clone());
+        self.order.push_back((key, now));
+        true
+    }
+
+    /// Removing entries older than ttl
+    fn expire(&mut self, now: Instant) {
+        loop {
+            let expired = match self.order.front() {
+                Some(&(_, t)) => now.duration_since(t) > self.ttl,
+                None => false
+            };
+
+            if !expired {
+                break;
+            }
+
+            match self.order.pop_front() {
+                Some((k, _)) => {
+                    self.ids.remove(&k);
+                }
+                None => {}
+            }
+        }
+    }
+
+    #[inline(always)]
+    pub fn len(&self) -> usize {
+        self.order.len()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use helper::FakeClock;
+
+    #[test]
+    fn second_delivery_is_suppressed() {
+        let mut dedup = EventDedup::new(10, Duration::from_secs(60));
+        let from = String::from("node-a");
+        assert!(dedup.check(&from, 1));
+        assert!(!dedup.check(&from, 1));
+        assert_eq!(dedup.duplicates, 1);
+
+        // same ID from other Node is a different event
+        assert!(dedup.check(&String::from("node-b"), 1));
+    }
+
+    #[test]
+    fn events_without_id() {
+        let mut dedup = EventDedup::new(10, Duration::from_secs(60));
+        let from = String::from("node-a");
+        assert!(dedup.check(&from, 0));
+        assert!(dedup.check(&from, 0));
+        assert_eq!(dedup.len(), 0);
+
+        // zero size is disabling cache
+        let mut disabled = EventDedup::new(0, Duration::from_secs(60));
+        assert!(disabled.check(&from, 1));
+        assert!(disabled.check(&from, 1));
+    }
+
+    #[test]
+    fn expire_by_size() {
+        let mut dedup = EventDedup::new(2, Duration::from_secs(60));
+        let from = String::from("node-a");
+        assert!(dedup.check(&from, 1));
+        assert!(dedup.check(&from, 2));
+        assert!(dedup.check(&from, 3));
+        assert_eq!(dedup.len(), 2);
+
+        // oldest one was removed to keep size
+        assert!(dedup.check(&from, 1));
+        assert!(!dedup.check(&from, 3));
+    }
+
+    #[test]
+    fn expire_by_age() {
+        let clock = Arc::new(FakeClock::new());
+        let mut dedup = EventDedup::with_clock(10, Duration::from_secs(60), clock.clone());
+        let from = String::from("node-a");
+        assert!(dedup.check(&from, 1));
+
+        // still a duplicate at exactly ttl age
+        clock.advance(Duration::from_secs(60));
+        assert!(!dedup.check(&from, 1));
+
+        clock.advance(Duration::from_secs(1));
+        assert!(dedup.check(&from, 1));
+        assert_eq!(dedup.duplicates, 1);
+    }
+}
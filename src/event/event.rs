@@ -1,13 +1,24 @@
 #![allow(dead_code)]
 
 use helper::{Path, NetHelper, Log};
+use event::EventCodec;
 use std::error::Error;
+use std::io;
+use std::io::Write;
+use std::time::SystemTime;
 
+#[derive(Clone)]
 pub struct Event {
     pub path: Path,
     pub name: String,
     pub from: String,
     pub target: String,
+    // application defined version of "data" format
+    // 0 means that version is not specified
+    pub schema_version: u32,
+    // unique id of this event from "from" node for detecting duplicates
+    // 0 means that event doesn't have an id
+    pub id: u64,
     pub data: Vec<u8>,
 }
 
@@ -19,6 +30,8 @@ impl Event {
             name: String::new(),
             from: String::new(),
             target: String::new(),
+            schema_version: 0,
+            id: 0,
             data: vec![],
         }
     }
@@ -83,7 +96,7 @@ impl Event {
             }
         };
 
-        // Reading Event From
+        // Reading Event Target
         ev.target = match Event::read_field(&data, offset, data_len) {
             Some((field_data, field_len)) => {
                 offset += field_len;
@@ -102,6 +115,32 @@ impl Event {
             }
         };
 
+        // Reading Event data Schema Version
+        ev.schema_version = match NetHelper::bytes_to_u32(&data, offset) {
+            (true, v) => {
+                offset += 4;
+                v
+            }
+
+            (false, _) => {
+                Log::warn("Unable to Parse Schema Version from Event Message", "Error while trying to read Schema Version Field");
+                return None;
+            }
+        };
+
+        // Reading Event ID
+        ev.id = match NetHelper::bytes_to_u64(&data, offset) {
+            (true, v) => {
+                offset += 8;
+                v
+            }
+
+            (false, _) => {
+                Log::warn("Unable to Parse ID from Event Message", "Error while trying to read ID Field");
+                return None;
+            }
+        };
+
         // we got all fields in event
         // so remaining data is for event data field
         ev.data = Vec::from(&data[offset..]);
@@ -112,11 +151,13 @@ impl Event {
     fn read_field(data: &Vec<u8>, offset: usize, data_len: usize) -> Option<(&[u8], usize)> {
         let (converted, filed_len) = NetHelper::bytes_to_u32(&data, offset);
         let filed_len = filed_len as usize;
-        if !converted || offset + filed_len >= data_len {
+        // field data is starting after 4 bytes of BigEndian length
+        if !converted || offset + 4 + filed_len > data_len {
             return None
         }
 
-        Some((&data[offset..(offset + filed_len)], filed_len))
+        // returning field data and total bytes count used by this field
+        Some((&data[(offset + 4)..(offset + 4 + filed_len)], 4 + filed_len))
     }
 
     #[inline(always)]
@@ -128,15 +169,14 @@ impl Event {
             + 4 + name_len // name len endian and name bytes len
             + 4 + from_len // from len endian and from bytes len
             + 4 + target_len // target len endian and target bytes len
+            + 4 // schema version endian
+            + 8 // event id endian
             + event_data_len; // event data bytes len
 
-        // Adding +4 because we need to write also big endian total data length
-        let mut buffer: Vec<u8> = vec![0; (data_len + 4)];
+        // total data length is not included, it's added by connection framing
+        let mut buffer: Vec<u8> = vec![0; data_len];
         let mut offset: usize = 0;
 
-        // writing total data length
-        offset += NetHelper::u32_to_bytes(data_len as u32, &mut buffer, offset);
-
         // writing Event Path field
         offset += NetHelper::u32_to_bytes(path_len as u32, &mut buffer, offset);
         match self.path.to_bytes() {
@@ -163,14 +203,121 @@ impl Event {
         offset += from_len;
 
 
-        // Writing Event From Field
+        // Writing Event Target Field
         offset += NetHelper::u32_to_bytes(target_len as u32, &mut buffer, offset);
         buffer[offset..offset + target_len].copy_from_slice(self.target.as_bytes());
         offset += target_len;
 
+        // Writing Event data Schema Version
+        offset += NetHelper::u32_to_bytes(self.schema_version, &mut buffer, offset);
+
+        // Writing Event ID
+        offset += NetHelper::u64_to_bytes(self.id, &mut buffer, offset);
+
         // remaining should be out event data
         buffer[offset..].copy_from_slice(self.data.as_slice());
 
         Some(buffer)
     }
-}
\ No newline at end of file
+
+    /// Writing length framed event to any writer, event data is made by given codec
+    /// Returns total bytes written including 4 bytes length
+    pub fn write_to<W: Write>(&self, codec: &EventCodec, writer: &mut W) -> io::Result<usize> {
+        let data = match codec.encode(self) {
+            Some(d) => d,
+            None => return Err(io::Error::new(io::ErrorKind::InvalidData, "Unable to convert Event into Data bytes"))
+        };
+
+        let mut length = vec![0; 4];
+        NetHelper::u32_to_bytes(data.len() as u32, &mut length, 0);
+        writer.write_all(length.as_slice())?;
+        writer.write_all(data.as_slice())?;
+        Ok(4 + data.len())
+    }
+}
+
+/// Event received from connection
+/// with token of the connection which sent it
+pub struct ReceivedEvent {
+    pub token: String,
+    pub event: Event
+}
+
+/// Direction of the event copy given to taps
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum TapDirection {
+    Inbound,
+    Outbound
+}
+
+/// Read only copy of event which Node received or sent
+/// "tokens" are connections which event came from or was sent to
+pub struct TappedEvent {
+    pub direction: TapDirection,
+    pub time: SystemTime,
+    pub tokens: Vec<String>,
+    pub event: Event
+}
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use event::RawEventCodec;
+
+    fn sample_event() -> Event {
+        let mut ev = Event::default();
+        ev.path.mul(3);
+        ev.path.mul(5);
+        ev.name = String::from("update");
+        ev.from = String::from("node-a");
+        ev.target = String::from("node-b");
+        ev.schema_version = 7;
+        ev.id = 42;
+        ev.data = vec![1, 2, 3, 0, 255];
+        ev
+    }
+
+    #[test]
+    fn raw_round_trip() {
+        let ev = sample_event();
+        let raw = ev.to_raw().unwrap();
+        let parsed = Event::from_raw(&raw).unwrap();
+        assert!(parsed.path.dividable(15));
+        assert_eq!(parsed.name, ev.name);
+        assert_eq!(parsed.from, ev.from);
+        assert_eq!(parsed.target, ev.target);
+        assert_eq!(parsed.schema_version, 7);
+        assert_eq!(parsed.id, 42);
+        assert_eq!(parsed.data, ev.data);
+    }
+
+    #[test]
+    fn schema_version_defaults_to_unspecified() {
+        let raw = Event::default().to_raw().unwrap();
+        let parsed = Event::from_raw(&raw).unwrap();
+        assert_eq!(parsed.schema_version, 0);
+        assert_eq!(parsed.id, 0);
+        assert!(parsed.data.is_empty());
+    }
+
+    #[test]
+    fn write_framed() {
+        let ev = sample_event();
+        let mut buffer: Vec<u8> = vec![];
+        let written = ev.write_to(&RawEventCodec, &mut buffer).unwrap();
+
+        let raw = ev.to_raw().unwrap();
+        assert_eq!(written, 4 + raw.len());
+        assert_eq!(buffer.len(), written);
+        assert_eq!(NetHelper::bytes_to_u32(&buffer, 0), (true, raw.len() as u32));
+        assert_eq!(&buffer[4..], raw.as_slice());
+    }
+
+    #[test]
+    fn truncated_data() {
+        let raw = sample_event().to_raw().unwrap();
+        // cutting inside the fixed size fields after target
+        for end in 0..(raw.len() - 5) {
+            assert!(Event::from_raw(&Vec::from(&raw[..end])).is_none());
+        }
+    }
+}
@@ -4,14 +4,27 @@ extern crate mio;
 use self::mio::{PollOpt, Ready};
 
 use node::{Node, EVENT_RECEIVER_CHANNEL_TOKEN};
-use event::Event;
+use event::{Event, CallbackWatchdog};
 use helper::Log;
 
 use std::error::Error;
 use std::process;
+use std::collections::BTreeMap;
+use std::time::Duration;
+use std::mem;
 
 pub type EventCallback = Box<Fn(&Event, &mut Node) -> bool>;
 
+/// What to do with triggered event which doesn't have any callbacks
+pub enum UnhandledEventPolicy {
+    // just ignoring event, this is the default
+    Silent,
+    // logging event name, useful for finding missing subscriptions
+    Log,
+    // calling given callback instead
+    Fallback(EventCallback)
+}
+
 
 pub enum EventCMD {
     None,
@@ -36,6 +49,48 @@ impl EventCommand {
 }
 
 
+/// Recorded information about specific event triggering
+#[derive(Clone)]
+pub struct EventMetrics {
+    // how many times event was triggered
+    pub fire_count: u64,
+
+    // time spent inside callbacks of this event
+    pub total_duration: Duration,
+    pub max_duration: Duration
+}
+
+impl EventMetrics {
+    #[inline(always)]
+    pub fn new() -> EventMetrics {
+        EventMetrics {
+            fire_count: 0,
+            total_duration: Duration::new(0, 0),
+            max_duration: Duration::new(0, 0)
+        }
+    }
+
+    #[inline(always)]
+    pub fn record(&mut self, duration: Duration) {
+        self.fire_count += 1;
+        self.total_duration += duration;
+        if duration > self.max_duration {
+            self.max_duration = duration;
+        }
+    }
+
+    /// Average time spent inside callbacks for one event trigger
+    pub fn average_duration(&self) -> Duration {
+        if self.fire_count == 0 {
+            return Duration::new(0, 0);
+        }
+
+        let total_nanos = self.total_duration.as_secs() * 1_000_000_000 + self.total_duration.subsec_nanos() as u64;
+        let average = total_nanos / self.fire_count;
+        Duration::new(average / 1_000_000_000, (average % 1_000_000_000) as u32)
+    }
+}
+
 pub trait EventHandler {
     /// Init event handler
     fn init_event(&mut self);
@@ -43,6 +98,12 @@ pub trait EventHandler {
     /// or adding an event with given name if it's not exists
     fn on(&mut self, name: &str, callback: EventCallback);
 
+    /// Adding callback with priority, callbacks with higher priority
+    /// are called first, same priority callbacks are called in registration order
+    /// "on" is using priority 0
+    /// Callback returning false is stopping all callbacks after it
+    fn on_priority(&mut self, name: &str, priority: i32, callback: EventCallback);
+
     /// Removing event from callbacks list
     fn rm(&mut self, name: &str);
 
@@ -55,6 +116,20 @@ pub trait EventHandler {
 
     /// handle POLL event and read data from channel
     fn event_notify(&mut self);
+
+    /// Getting metrics for triggered events by event name
+    /// metrics are recorded only if they are enabled for Node
+    fn event_metrics(&self) -> &BTreeMap<String, EventMetrics>;
+
+    /// Setting what to do with events which don't have callbacks
+    fn set_unhandled_policy(&mut self, policy: UnhandledEventPolicy);
+
+    /// Setting what to do with given event if it doesn't have callbacks
+    /// instead of the policy set by "set_unhandled_policy"
+    fn set_unhandled_policy_for(&mut self, name: &str, policy: UnhandledEventPolicy);
+
+    /// Getting count of registered callbacks by event name
+    fn event_handlers(&self) -> BTreeMap<String, usize>;
 }
 
 impl EventHandler for Node {
@@ -71,18 +146,33 @@ impl EventHandler for Node {
                 process::exit(1);
             }
         }
+
+        if let Some(ref watchdog) = self.event_watchdog {
+            CallbackWatchdog::watch(watchdog);
+        }
     }
 
     #[inline(always)]
     fn on(&mut self, name: &str, callback: EventCallback) {
+        self.on_priority(name, 0, callback);
+    }
+
+    #[inline(always)]
+    fn on_priority(&mut self, name: &str, priority: i32, callback: EventCallback) {
         let name_str = String::from(name);
         let cbs = match self.callbacks.remove(&name_str) {
             Some(mut callbacks) => {
-                callbacks.push(callback);
+                // keeping callbacks sorted by priority
+                // new one goes after all callbacks with the same priority
+                let index = match callbacks.iter().position(|&(p, _)| p < priority) {
+                    Some(i) => i,
+                    None => callbacks.len()
+                };
+                callbacks.insert(index, (priority, callback));
                 callbacks
             }
 
-            None => vec![callback]
+            None => vec![(priority, callback)]
         };
 
         self.callbacks.insert(name_str, cbs);
@@ -95,19 +185,85 @@ impl EventHandler for Node {
 
     #[inline(always)]
     fn trigger(&mut self, event: &Event) {
-        if !self.callbacks.contains_key(&event.name) {
-            return;
-        }
+        // measuring time only if we need metrics
+        let started = if self.event_metrics_enabled { Some(self.clock.now()) } else { None };
+
+        match self.callbacks.remove(&event.name) {
+            Some(callbacks) => {
+                for &(_, ref cb) in &callbacks {
+                    // measuring single callback only if we need to log slow ones
+                    let cb_started = if self.event_slow_threshold.is_some() { Some(self.clock.now()) } else { None };
+                    if let Some(ref watchdog) = self.event_watchdog {
+                        watchdog.started(event.name.as_str());
+                    }
+                    let next = cb(event, self);
+                    if let Some(ref watchdog) = self.event_watchdog {
+                        watchdog.finished();
+                    }
 
-        let callbacks = self.callbacks.remove(&event.name).unwrap();
-        for cb in &callbacks {
-            // if callback returning false then breaking the loop
-            if !cb(event, self) {
-                break;
+                    if let (Some(t), Some(threshold)) = (cb_started, self.event_slow_threshold) {
+                        let elapsed = self.clock.now().duration_since(t);
+                        if elapsed > threshold {
+                            Log::warn(format!("Slow callback for event {}", event.name).as_str()
+                                      , format!("{}.{:03}s", elapsed.as_secs(), elapsed.subsec_nanos() / 1000000).as_str());
+                        }
+                    }
+
+                    // if callback returning false then breaking the loop
+                    if !next {
+                        break;
+                    }
+                }
+
+                self.callbacks.insert(event.name.clone(), callbacks);
+            }
+
+            None => {
+                // taking policy out, because fallback callback
+                // needs mutable Node as an argument
+                // policy for this event name is used instead of the default one if it's set
+                let (policy, for_name) = match self.event_unhandled_policies.remove(&event.name) {
+                    Some(p) => (p, true),
+                    None => (mem::replace(&mut self.event_unhandled_policy, UnhandledEventPolicy::Silent), false)
+                };
+                let outer_changed = mem::replace(&mut self.event_unhandled_policy_changed, false);
+                match policy {
+                    UnhandledEventPolicy::Silent => {}
+                    UnhandledEventPolicy::Log => {
+                        Log::info("Triggered event without callbacks", event.name.as_str());
+                    }
+                    UnhandledEventPolicy::Fallback(ref cb) => {
+                        if let Some(ref watchdog) = self.event_watchdog {
+                            watchdog.started(event.name.as_str());
+                        }
+                        cb(event, self);
+                        if let Some(ref watchdog) = self.event_watchdog {
+                            watchdog.finished();
+                        }
+                    }
+                }
+
+                // if callback didn't set a new policy, keeping old one
+                if for_name {
+                    if !self.event_unhandled_policies.contains_key(&event.name) {
+                        self.event_unhandled_policies.insert(event.name.clone(), policy);
+                    }
+                } else if !self.event_unhandled_policy_changed {
+                    self.event_unhandled_policy = policy;
+                }
+                self.event_unhandled_policy_changed = outer_changed || self.event_unhandled_policy_changed;
             }
         }
 
-        self.callbacks.insert(event.name.clone(), callbacks);
+        match started {
+            Some(t) => {
+                self.event_metrics.entry(event.name.clone())
+                    .or_insert(EventMetrics::new())
+                    .record(self.clock.now().duration_since(t));
+            }
+
+            None => {}
+        }
     }
 
     #[inline(always)]
@@ -139,12 +295,300 @@ impl EventHandler for Node {
                 }
                 // if we got error, then data is unavailable
                 // and breaking receive loop
-                Err(e) => {
-                    Log::warn("EventHandler receiver channel data is not available",
-                              e.description());
+                Err(_) => {
                     break;
                 }
             }
         }
     }
-}
\ No newline at end of file
+
+    #[inline(always)]
+    fn event_metrics(&self) -> &BTreeMap<String, EventMetrics> {
+        &self.event_metrics
+    }
+
+    #[inline(always)]
+    fn set_unhandled_policy(&mut self, policy: UnhandledEventPolicy) {
+        self.event_unhandled_policy = policy;
+        self.event_unhandled_policy_changed = true;
+    }
+
+    #[inline(always)]
+    fn set_unhandled_policy_for(&mut self, name: &str, policy: UnhandledEventPolicy) {
+        self.event_unhandled_policies.insert(String::from(name), policy);
+    }
+
+    #[inline(always)]
+    fn event_handlers(&self) -> BTreeMap<String, usize> {
+        let mut handlers: BTreeMap<String, usize> = BTreeMap::new();
+        for (name, callbacks) in &self.callbacks {
+            handlers.insert(name.clone(), callbacks.len());
+        }
+
+        handlers
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use node::testing::{self, Peer};
+    use helper::FakeClock;
+    use std::sync::Arc;
+    use std::rc::Rc;
+    use std::cell::{Cell, RefCell};
+
+    fn event(name: &str, data: Vec<u8>) -> Event {
+        let mut ev = Event::default();
+        ev.name = String::from(name);
+        ev.data = data;
+        ev
+    }
+
+    /// Node with fake clock, which is moved by callbacks
+    fn timed_node(values: &[(&str, &str)]) -> (Node, Arc<FakeClock>) {
+        let mut node = testing::node(values);
+        let clock = Arc::new(FakeClock::new());
+        node.clock = clock.clone();
+        (node, clock)
+    }
+
+    #[test]
+    fn metrics_count_and_duration() {
+        let (mut node, clock) = timed_node(&[("event_metrics", "true")]);
+        // callback is running as many milliseconds as event data says
+        let callback_clock = clock.clone();
+        node.on("tick", Box::new(move |ev: &Event, _: &mut Node| {
+            callback_clock.advance(Duration::from_millis(ev.data[0] as u64));
+            true
+        }));
+
+        node.trigger(&event("tick", vec![10]));
+        node.trigger(&event("tick", vec![30]));
+        let metrics = node.event_metrics().get("tick").unwrap().clone();
+        assert_eq!(metrics.fire_count, 2);
+        assert_eq!(metrics.total_duration, Duration::from_millis(40));
+        assert_eq!(metrics.max_duration, Duration::from_millis(30));
+        assert_eq!(metrics.average_duration(), Duration::from_millis(20));
+    }
+
+    #[test]
+    fn metrics_disabled() {
+        let mut node = testing::node(&[]);
+        node.on("tick", Box::new(|_: &Event, _: &mut Node| true));
+        node.trigger(&event("tick", vec![]));
+        assert!(node.event_metrics().is_empty());
+    }
+
+    #[test]
+    fn received_events_are_triggered() {
+        let mut node = testing::node(&[("event_metrics", "true")]);
+        let mut child = Peer::connect(&mut node, "child", 3);
+
+        child.send(&event("ping", vec![]));
+        testing::run_until(&mut node, |n| n.event_metrics().contains_key("ping"));
+        assert_eq!(node.event_metrics()["ping"].fire_count, 1);
+    }
+
+    /// Fallback callback counting its calls
+    fn counting_fallback(count: &Rc<Cell<usize>>) -> UnhandledEventPolicy {
+        let count = count.clone();
+        UnhandledEventPolicy::Fallback(Box::new(move |_: &Event, _: &mut Node| {
+            count.set(count.get() + 1);
+            true
+        }))
+    }
+
+    #[test]
+    fn unhandled_silent_by_default() {
+        let mut node = testing::node(&[]);
+        let lines = Log::capture(|| node.trigger(&event("missing", vec![])));
+        assert!(lines.is_empty());
+    }
+
+    #[test]
+    fn unhandled_logged() {
+        let mut node = testing::node(&[]);
+        node.set_unhandled_policy(UnhandledEventPolicy::Log);
+        let lines = Log::capture(|| node.trigger(&event("missing", vec![])));
+        assert_eq!(lines, vec![String::from("[INFO] Triggered event without callbacks -> missing")]);
+    }
+
+    #[test]
+    fn unhandled_fallback_kept_for_next_events() {
+        let mut node = testing::node(&[]);
+        let count = Rc::new(Cell::new(0));
+        node.set_unhandled_policy(counting_fallback(&count));
+        node.on("known", Box::new(|_: &Event, _: &mut Node| true));
+
+        node.trigger(&event("missing", vec![]));
+        node.trigger(&event("other", vec![]));
+        node.trigger(&event("known", vec![]));
+        assert_eq!(count.get(), 2);
+    }
+
+    #[test]
+    fn fallback_could_change_policy() {
+        let mut node = testing::node(&[]);
+        let count = Rc::new(Cell::new(0));
+        let callback_count = count.clone();
+        node.set_unhandled_policy(UnhandledEventPolicy::Fallback(Box::new(move |_: &Event, node: &mut Node| {
+            callback_count.set(callback_count.get() + 1);
+            node.set_unhandled_policy(UnhandledEventPolicy::Silent);
+            true
+        })));
+
+        node.trigger(&event("missing", vec![]));
+        node.trigger(&event("missing", vec![]));
+        assert_eq!(count.get(), 1);
+    }
+
+    #[test]
+    fn unhandled_policy_for_name() {
+        let mut node = testing::node(&[]);
+        let count = Rc::new(Cell::new(0));
+        node.set_unhandled_policy(UnhandledEventPolicy::Log);
+        node.set_unhandled_policy_for("quiet", UnhandledEventPolicy::Silent);
+        node.set_unhandled_policy_for("counted", counting_fallback(&count));
+
+        let lines = Log::capture(|| {
+            node.trigger(&event("quiet", vec![]));
+            node.trigger(&event("counted", vec![]));
+            node.trigger(&event("counted", vec![]));
+            node.trigger(&event("other", vec![]));
+        });
+        assert_eq!(lines, vec![String::from("[INFO] Triggered event without callbacks -> other")]);
+        assert_eq!(count.get(), 2);
+    }
+
+    /// Callback which is writing its label to shared list and returning given result
+    fn recording(calls: &Rc<RefCell<Vec<&'static str>>>, label: &'static str, next: bool) -> EventCallback {
+        let calls = calls.clone();
+        Box::new(move |_: &Event, _: &mut Node| {
+            calls.borrow_mut().push(label);
+            next
+        })
+    }
+
+    #[test]
+    fn callbacks_ordered_by_priority() {
+        let mut node = testing::node(&[]);
+        let calls = Rc::new(RefCell::new(vec![]));
+        node.on_priority("ev", -5, recording(&calls, "low", true));
+        node.on("ev", recording(&calls, "default", true));
+        node.on_priority("ev", 10, recording(&calls, "high", true));
+
+        node.trigger(&event("ev", vec![]));
+        assert_eq!(*calls.borrow(), vec!["high", "default", "low"]);
+    }
+
+    #[test]
+    fn same_priority_keeps_registration_order() {
+        let mut node = testing::node(&[]);
+        let calls = Rc::new(RefCell::new(vec![]));
+        node.on_priority("ev", 1, recording(&calls, "first", true));
+        node.on_priority("ev", 1, recording(&calls, "second", true));
+        node.on_priority("ev", 2, recording(&calls, "higher", true));
+        node.on_priority("ev", 1, recording(&calls, "third", true));
+
+        node.trigger(&event("ev", vec![]));
+        assert_eq!(*calls.borrow(), vec!["higher", "first", "second", "third"]);
+    }
+
+    #[test]
+    fn higher_priority_callback_could_stop_others() {
+        let mut node = testing::node(&[]);
+        let calls = Rc::new(RefCell::new(vec![]));
+        node.on("ev", recording(&calls, "regular", true));
+        node.on_priority("ev", 100, recording(&calls, "guard", false));
+
+        node.trigger(&event("ev", vec![]));
+        node.trigger(&event("ev", vec![]));
+        assert_eq!(*calls.borrow(), vec!["guard", "guard"]);
+    }
+
+    #[test]
+    fn slow_callback_logged() {
+        let (mut node, clock) = timed_node(&[("slow_callback", "0")]);
+        let callback_clock = clock.clone();
+        node.on("slow", Box::new(move |_: &Event, _: &mut Node| {
+            callback_clock.advance(Duration::from_millis(1500));
+            true
+        }));
+        // taking no time at all is not slower than zero threshold
+        node.on("instant", Box::new(|_: &Event, _: &mut Node| true));
+
+        let lines = Log::capture(|| {
+            node.trigger(&event("slow", vec![]));
+            node.trigger(&event("instant", vec![]));
+        });
+        assert_eq!(lines, vec![String::from("[WARNING] Slow callback for event slow -> 1.500s")]);
+    }
+
+    #[test]
+    fn slow_callback_disabled() {
+        let (mut node, clock) = timed_node(&[]);
+        let callback_clock = clock.clone();
+        node.on("slow", Box::new(move |_: &Event, _: &mut Node| {
+            callback_clock.advance(Duration::from_secs(60));
+            true
+        }));
+
+        assert!(Log::capture(|| node.trigger(&event("slow", vec![]))).is_empty());
+    }
+
+    #[test]
+    fn handlers_counted_by_name() {
+        let mut node = testing::node(&[]);
+        assert!(node.event_handlers().is_empty());
+
+        node.on("a", Box::new(|_: &Event, _: &mut Node| true));
+        node.on_priority("a", 5, Box::new(|_: &Event, _: &mut Node| true));
+        node.on("b", Box::new(|_: &Event, _: &mut Node| true));
+        let handlers = node.event_handlers();
+        assert_eq!(handlers.len(), 2);
+        assert_eq!(handlers["a"], 2);
+        assert_eq!(handlers["b"], 1);
+
+        // removed events are not listed, triggering is not changing counts
+        node.rm("b");
+        node.trigger(&event("a", vec![]));
+        assert_eq!(node.event_handlers().into_iter().collect::<Vec<_>>(), vec![(String::from("a"), 2)]);
+    }
+
+    #[test]
+    fn callback_branches_on_schema_version() {
+        let mut node = testing::node(&[]);
+        let handled = Rc::new(RefCell::new(vec![]));
+        let callback_handled = handled.clone();
+        // version 2 is current format, version 1 is migrated by adding default field
+        // and everything else is rejected
+        node.on("update", Box::new(move |ev: &Event, _: &mut Node| {
+            let data = match ev.schema_version {
+                2 => ev.data.clone(),
+                1 => {
+                    let mut data = ev.data.clone();
+                    data.push(0);
+                    data
+                }
+                _ => return false
+            };
+            callback_handled.borrow_mut().push(data);
+            true
+        }));
+
+        let mut child = Peer::connect(&mut node, "child", 3);
+        for &(id, schema_version) in &[(1, 1), (2, 2), (3, 0), (4, 7)] {
+            let mut ev = event("update", vec![id as u8]);
+            ev.from = String::from("child");
+            ev.id = id;
+            ev.schema_version = schema_version;
+            child.send(&ev);
+        }
+
+        let counted = handled.clone();
+        testing::run_until(&mut node, |_| counted.borrow().len() == 2);
+        testing::run_for(&mut node, Duration::from_millis(100));
+        assert_eq!(*handled.borrow(), vec![vec![1, 0], vec![2]]);
+    }
+}
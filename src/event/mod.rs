@@ -1,3 +1,11 @@
 mod event;
+mod handler;
+mod dedup;
+mod codec;
+mod watchdog;
 
-pub use self::event::Event;
\ No newline at end of file
+pub use self::event::{Event, ReceivedEvent, TappedEvent, TapDirection};
+pub use self::handler::{EventHandler, EventCallback, EventCommand, EventMetrics, UnhandledEventPolicy};
+pub use self::dedup::EventDedup;
+pub use self::codec::{EventCodec, RawEventCodec};
+pub use self::watchdog::CallbackWatchdog;
\ No newline at end of file
@@ -0,0 +1,160 @@
+#![allow(dead_code)]
+
+use helper::{Log, Clock};
+
+use std::sync::{Arc, Weak, Mutex};
+use std::thread;
+use std::time::{Duration, Instant};
+
+/// Watching event callbacks running on Node thread from a separate thread
+/// Callback which never returns is blocking the whole Node, so it's reported while it's still running
+/// Only running callbacks are watched, so idle connections are never reported
+pub struct CallbackWatchdog {
+    // event names of running callbacks, their start time
+    // and true if it was already reported
+    // callback could trigger other events, so it's a stack of nested calls
+    running: Mutex<Vec<(String, Instant, bool)>>,
+
+    // how long callback could run before it's reported
+    pub limit: Duration,
+
+    clock: Arc<Clock>
+}
+
+impl CallbackWatchdog {
+    pub fn new(limit: Duration, clock: Arc<Clock>) -> CallbackWatchdog {
+        CallbackWatchdog {
+            running: Mutex::new(vec![]),
+            limit: limit,
+            clock: clock
+        }
+    }
+
+    /// Marking start of the callback for given event
+    #[inline(always)]
+    pub fn started(&self, name: &str) {
+        let now = self.clock.now();
+        self.running.lock().unwrap().push((String::from(name), now, false));
+    }
+
+    /// Marking that last started callback returned
+    #[inline(always)]
+    pub fn finished(&self) {
+        self.running.lock().unwrap().pop();
+    }
+
+    /// Getting event name and running time of the callback which is running longer than limit
+    /// the same callback run is returned only once
+    pub fn check(&self) -> Option<(String, Duration)> {
+        let now = self.clock.now();
+        let mut running = self.running.lock().unwrap();
+        for &mut (ref name, started, ref mut reported) in running.iter_mut() {
+            let elapsed = now.duration_since(started);
+            if *reported || elapsed <= self.limit {
+                continue;
+            }
+
+            *reported = true;
+            return Some((name.clone(), elapsed));
+        }
+
+        None
+    }
+
+    /// Starting thread which is checking running callbacks and logging stuck ones
+    /// thread stops after watchdog is dropped
+    pub fn watch(watchdog: &Arc<CallbackWatchdog>) {
+        let weak: Weak<CallbackWatchdog> = Arc::downgrade(watchdog);
+        let interval = watchdog.limit / 2;
+        thread::spawn(move || {
+            loop {
+                thread::sleep(interval);
+                let watchdog = match weak.upgrade() {
+                    Some(w) => w,
+                    None => return
+                };
+
+                if let Some((name, elapsed)) = watchdog.check() {
+                    Log::warn(format!("Callback for event {} is still running, Node is not handling anything else", name).as_str()
+                              , format!("{}.{:03}s", elapsed.as_secs(), elapsed.subsec_nanos() / 1000000).as_str());
+                }
+            }
+        });
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use helper::FakeClock;
+    use std::sync::mpsc::channel;
+
+    #[test]
+    fn reports_stuck_callback_once() {
+        let clock = Arc::new(FakeClock::new());
+        let watchdog = CallbackWatchdog::new(Duration::from_secs(10), clock.clone());
+
+        watchdog.started("stuck");
+        clock.advance(Duration::from_secs(10));
+        assert!(watchdog.check().is_none());
+
+        clock.advance(Duration::from_secs(1));
+        assert_eq!(watchdog.check(), Some((String::from("stuck"), Duration::from_secs(11))));
+        clock.advance(Duration::from_secs(10));
+        assert!(watchdog.check().is_none());
+
+        // next run of the same event is watched again
+        watchdog.finished();
+        watchdog.started("stuck");
+        clock.advance(Duration::from_secs(11));
+        assert!(watchdog.check().is_some());
+    }
+
+    #[test]
+    fn nested_callback_keeps_outer_one() {
+        let clock = Arc::new(FakeClock::new());
+        let watchdog = CallbackWatchdog::new(Duration::from_secs(10), clock.clone());
+
+        watchdog.started("outer");
+        watchdog.started("inner");
+        watchdog.finished();
+        clock.advance(Duration::from_secs(11));
+        assert_eq!(watchdog.check().map(|(name, _)| name), Some(String::from("outer")));
+    }
+
+    #[test]
+    fn finished_callback_is_not_reported() {
+        let clock = Arc::new(FakeClock::new());
+        let watchdog = CallbackWatchdog::new(Duration::from_secs(10), clock.clone());
+
+        watchdog.started("quick");
+        watchdog.finished();
+        clock.advance(Duration::from_secs(60));
+        assert!(watchdog.check().is_none());
+    }
+
+    #[test]
+    fn stuck_handler_on_other_thread() {
+        let clock = Arc::new(FakeClock::new());
+        let watchdog = Arc::new(CallbackWatchdog::new(Duration::from_secs(10), clock.clone()));
+        let (started_s, started_r) = channel::<()>();
+        let (release_s, release_r) = channel::<()>();
+
+        // handler which is blocked until test releases it
+        let handler_watchdog = watchdog.clone();
+        let handler = thread::spawn(move || {
+            handler_watchdog.started("deadlock");
+            started_s.send(()).unwrap();
+            release_r.recv().unwrap();
+            handler_watchdog.finished();
+        });
+
+        started_r.recv().unwrap();
+        clock.advance(Duration::from_secs(30));
+        assert_eq!(watchdog.check().map(|(name, _)| name), Some(String::from("deadlock")));
+
+        release_s.send(()).unwrap();
+        handler.join().unwrap();
+        assert!(watchdog.check().is_none());
+    }
+}
@@ -0,0 +1,120 @@
+#![allow(dead_code)]
+
+use std::time::Duration;
+use std::u64;
+
+/// Exponential backoff for computing delays between retries
+/// Delay is doubled for each attempt, starting from "base" and capped by "max"
+pub struct Backoff {
+    pub base: Duration,
+    pub max: Duration,
+
+    // part of the delay which could be randomly removed, between 0 and 1
+    // 0 is making delays exactly exponential
+    pub jitter: f64
+}
+
+impl Backoff {
+    #[inline(always)]
+    pub fn new(base: Duration, max: Duration, jitter: f64) -> Backoff {
+        Backoff {
+            base: base,
+            max: max,
+            jitter: jitter
+        }
+    }
+
+    /// Computing delay for given attempt, first attempt is 0
+    /// "random" should be between 0 and 1, it's given by caller
+    /// so the same inputs are always giving the same delay
+    pub fn delay(&self, attempt: u32, random: f64) -> Duration {
+        let base_ms = Backoff::duration_ms(self.base);
+        let max_ms = Backoff::duration_ms(self.max);
+
+        let multiplier = if attempt >= 64 { u64::MAX } else { 1u64 << attempt };
+        let mut delay_ms = base_ms.saturating_mul(multiplier);
+        if delay_ms > max_ms {
+            delay_ms = max_ms;
+        }
+
+        let jitter = Backoff::clamp(self.jitter) * Backoff::clamp(random);
+        delay_ms -= (delay_ms as f64 * jitter) as u64;
+
+        Duration::from_millis(delay_ms)
+    }
+
+    #[inline(always)]
+    fn duration_ms(d: Duration) -> u64 {
+        d.as_secs().saturating_mul(1000).saturating_add((d.subsec_nanos() / 1000000) as u64)
+    }
+
+    #[inline(always)]
+    fn clamp(value: f64) -> f64 {
+        if value < 0.0 {
+            0.0
+        } else if value > 1.0 {
+            1.0
+        } else {
+            value
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Simple LCG for making the same "random" values on every run
+    struct SeededRandom(u64);
+
+    impl SeededRandom {
+        fn next(&mut self) -> f64 {
+            self.0 = self.0.wrapping_mul(6364136223846793005).wrapping_add(1442695040888963407);
+            (self.0 >> 11) as f64 / (1u64 << 53) as f64
+        }
+    }
+
+    #[test]
+    fn exact_sequence() {
+        let backoff = Backoff::new(Duration::from_millis(100), Duration::from_millis(1000), 0.0);
+        let delays: Vec<u64> = (0..6).map(|a| Backoff::duration_ms(backoff.delay(a, 0.5))).collect();
+        assert_eq!(delays, vec![100, 200, 400, 800, 1000, 1000]);
+    }
+
+    #[test]
+    fn monotonic_up_to_cap() {
+        let backoff = Backoff::new(Duration::from_millis(30), Duration::from_secs(60), 0.0);
+        let mut previous = Duration::new(0, 0);
+        for attempt in 0..200 {
+            let delay = backoff.delay(attempt, 0.0);
+            assert!(delay >= previous);
+            assert!(delay <= backoff.max);
+            previous = delay;
+        }
+        assert_eq!(previous, backoff.max);
+    }
+
+    #[test]
+    fn jitter_bounds() {
+        let backoff = Backoff::new(Duration::from_millis(100), Duration::from_secs(10), 0.25);
+        let exact = Backoff::new(Duration::from_millis(100), Duration::from_secs(10), 0.0);
+        let mut random = SeededRandom(42);
+        for attempt in 0..20 {
+            let full = Backoff::duration_ms(exact.delay(attempt, 0.0));
+            for _ in 0..50 {
+                let delay = Backoff::duration_ms(backoff.delay(attempt, random.next()));
+                assert!(delay <= full);
+                assert!(delay >= full - full / 4);
+            }
+        }
+    }
+
+    #[test]
+    fn out_of_range_inputs() {
+        let backoff = Backoff::new(Duration::from_millis(100), Duration::from_secs(1), 2.0);
+        // jitter and random are clamped to 0..1
+        assert_eq!(backoff.delay(0, 5.0), Duration::from_millis(0));
+        assert_eq!(backoff.delay(0, -1.0), Duration::from_millis(100));
+        assert_eq!(backoff.delay(u32::max_value(), 0.0), Duration::from_secs(1));
+    }
+}
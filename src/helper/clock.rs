@@ -0,0 +1,71 @@
+#![allow(dead_code)]
+
+use std::time::Instant;
+#[cfg(test)]
+use std::sync::Mutex;
+#[cfg(test)]
+use std::time::Duration;
+
+/// Source of the current time for time based logic
+/// like expiring entries and deadlines, so it could be replaced in tests
+pub trait Clock: Send + Sync {
+    fn now(&self) -> Instant;
+}
+
+/// Clock using system monotonic time, this is the default
+pub struct SystemClock;
+
+impl Clock for SystemClock {
+    #[inline(always)]
+    fn now(&self) -> Instant {
+        Instant::now()
+    }
+}
+
+/// Clock which is moving only when test is advancing it
+#[cfg(test)]
+pub struct FakeClock {
+    now: Mutex<Instant>
+}
+
+#[cfg(test)]
+impl FakeClock {
+    pub fn new() -> FakeClock {
+        FakeClock {
+            now: Mutex::new(Instant::now())
+        }
+    }
+
+    pub fn advance(&self, duration: Duration) {
+        let mut now = self.now.lock().unwrap();
+        *now += duration;
+    }
+}
+
+#[cfg(test)]
+impl Clock for FakeClock {
+    fn now(&self) -> Instant {
+        *self.now.lock().unwrap()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn fake_clock_moves_only_when_advanced() {
+        let clock = FakeClock::new();
+        let started = clock.now();
+        assert_eq!(clock.now(), started);
+
+        clock.advance(Duration::from_secs(5));
+        assert_eq!(clock.now().duration_since(started), Duration::from_secs(5));
+    }
+
+    #[test]
+    fn system_clock_is_monotonic() {
+        let first = SystemClock.now();
+        assert!(SystemClock.now() >= first);
+    }
+}
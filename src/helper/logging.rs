@@ -3,6 +3,15 @@ extern crate chrono;
 
 use self::chrono::prelude::UTC;
 
+#[cfg(test)]
+use std::cell::RefCell;
+
+#[cfg(test)]
+thread_local! {
+    // log lines captured for the current test thread, None if nothing is capturing
+    static CAPTURED: RefCell<Option<Vec<String>>> = RefCell::new(None);
+}
+
 pub struct Log {
 }
 
@@ -14,6 +23,22 @@ impl Log {
                  log_type,
                  message,
                  err);
+
+        #[cfg(test)]
+        CAPTURED.with(|captured| {
+            if let Some(ref mut lines) = *captured.borrow_mut() {
+                lines.push(format!("[{}] {} -> {}", log_type, message, err));
+            }
+        });
+    }
+
+    /// Getting lines logged from current thread while running given function
+    /// lines are in "[TYPE] message -> err" format
+    #[cfg(test)]
+    pub fn capture<F: FnOnce()>(f: F) -> Vec<String> {
+        CAPTURED.with(|captured| *captured.borrow_mut() = Some(vec![]));
+        f();
+        CAPTURED.with(|captured| captured.borrow_mut().take().unwrap_or(vec![]))
     }
 
     #[inline(always)]
@@ -31,3 +56,20 @@ impl Log {
         Log::print("WARNING", message, err);
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn capture_current_thread() {
+        let lines = Log::capture(|| {
+            Log::warn("Something happened", "details");
+        });
+        assert_eq!(lines, vec![String::from("[WARNING] Something happened -> details")]);
+
+        // nothing is captured outside of capture
+        Log::info("Not captured", "");
+        assert!(Log::capture(|| {}).is_empty());
+    }
+}
@@ -1,7 +1,17 @@
 mod logging;
 mod net;
 mod path;
+mod backoff;
+mod ring;
+mod clock;
+mod rate;
 
 pub use self::logging::Log;
 pub use self::net::NetHelper;
-pub use self::path::Path;
\ No newline at end of file
+pub use self::path::Path;
+pub use self::backoff::Backoff;
+pub use self::ring::HashRing;
+pub use self::clock::{Clock, SystemClock};
+pub use self::rate::RateLimiter;
+#[cfg(test)]
+pub use self::clock::FakeClock;
\ No newline at end of file
@@ -58,7 +58,7 @@ impl NetHelper {
     /// Parse given BigEndian bytes into u32 number
     #[inline(always)]
     pub fn bytes_to_u32(buffer: &Vec<u8>, offset: usize) -> (bool, u32) {
-        if buffer.len() + offset < 4 {
+        if buffer.len() < offset + 4 {
             return (false, 0);
         }
 
@@ -74,7 +74,7 @@ impl NetHelper {
     /// Parse given BigEndian bytes into u64 number
     #[inline(always)]
     pub fn bytes_to_u64(buffer: &Vec<u8>, offset: usize) -> (bool, u64) {
-        if buffer.len() + offset < 8 {
+        if buffer.len() < offset + 8 {
             return (false, 0);
         }
 
@@ -108,4 +108,57 @@ impl NetHelper {
             }
         }
     }
-}
\ No newline at end of file
+
+    /// Checking if given Node/API token is valid or not
+    /// Tokens are transferred as length framed bytes, so any UTF-8 text is possible
+    /// but by default we are accepting only printable tokens, to keep logs safe
+    /// from embedded new lines, null bytes and other control characters
+    pub fn validate_token(token: &str, allow_raw: bool) -> bool {
+        if token.len() == 0 {
+            return false;
+        }
+
+        allow_raw || !token.chars().any(|c| c.is_control())
+    }
+
+    /// Escaping control characters inside token for printing it to logs
+    pub fn escape_token(token: &str) -> String {
+        let mut escaped = String::with_capacity(token.len());
+        for c in token.chars() {
+            if c.is_control() {
+                escaped.extend(c.escape_default());
+            } else {
+                escaped.push(c);
+            }
+        }
+
+        escaped
+    }
+}
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn printable_tokens() {
+        assert!(NetHelper::validate_token("node-1", false));
+        assert!(NetHelper::validate_token("узел 1", false));
+        assert!(!NetHelper::validate_token("", false));
+        assert!(!NetHelper::validate_token("", true));
+    }
+
+    #[test]
+    fn control_characters() {
+        for token in &["node\n1", "node\0", "\x1b[31mnode", "node\t1"] {
+            assert!(!NetHelper::validate_token(token, false));
+            assert!(NetHelper::validate_token(token, true));
+        }
+    }
+
+    #[test]
+    fn escaping() {
+        assert_eq!(NetHelper::escape_token("node-1"), "node-1");
+        assert_eq!(NetHelper::escape_token("node\n1\0"), "node\\n1\\u{0}");
+        assert_eq!(NetHelper::escape_token("\"node\""), "\"node\"");
+    }
+}
@@ -4,6 +4,7 @@ use std::u64::{MAX as u64MAX};
 use helper::NetHelper;
 
 /// Base struct for handling path information and processing it
+#[derive(Clone)]
 pub struct Path {
     // parts for path calculations
     parts: Vec<u64>
@@ -0,0 +1,112 @@
+#![allow(dead_code)]
+
+use std::time::{Duration, Instant};
+
+/// Token bucket for limiting bytes per second
+/// bytes are taken after transfer, so single big chunk could take more than available
+/// and next transfer should wait until that debt is refilled
+pub struct RateLimiter {
+    // bytes per second
+    pub rate: u64,
+
+    // max bytes collected while connection is idle, it's one second of transfer
+    burst: f64,
+
+    // bytes which could be transferred right now
+    // negative when more bytes were transferred than allowed
+    available: f64,
+
+    // last time when available bytes were refilled
+    updated: Instant
+}
+
+impl RateLimiter {
+    #[inline(always)]
+    pub fn new(rate: u64, now: Instant) -> RateLimiter {
+        RateLimiter {
+            rate: rate,
+            burst: rate as f64,
+            available: rate as f64,
+            updated: now
+        }
+    }
+
+    fn refill(&mut self, now: Instant) {
+        if now <= self.updated {
+            return;
+        }
+
+        let elapsed = now - self.updated;
+        let elapsed = elapsed.as_secs() as f64 + elapsed.subsec_nanos() as f64 / 1e9;
+        self.available += elapsed * self.rate as f64;
+        if self.available > self.burst {
+            self.available = self.burst;
+        }
+        self.updated = now;
+    }
+
+    /// Getting count of bytes which could be transferred right now
+    pub fn available(&mut self, now: Instant) -> usize {
+        self.refill(now);
+        if self.available < 1.0 { 0 } else { self.available as usize }
+    }
+
+    /// Taking transferred bytes from bucket
+    /// Returns time to wait before next transfer, None if it could continue right away
+    pub fn take(&mut self, bytes: usize, now: Instant) -> Option<Duration> {
+        self.refill(now);
+        self.available -= bytes as f64;
+        self.wait()
+    }
+
+    /// Getting time until bytes for 1/10 of second could be transferred
+    /// for not waking up to transfer just a few bytes
+    fn wait(&self) -> Option<Duration> {
+        if self.available >= 1.0 {
+            return None;
+        }
+
+        let target = (self.rate as f64 / 10.0).max(1.0);
+        // rounding up to the next microsecond, so after waiting
+        // refill is surely giving target bytes, even with float rounding
+        let micros = ((target - self.available) / self.rate as f64 * 1e6) as u64 + 1;
+        Some(Duration::new(micros / 1000000, (micros % 1000000) as u32 * 1000))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn burst_then_wait() {
+        let now = Instant::now();
+        let mut limiter = RateLimiter::new(1000, now);
+        assert_eq!(limiter.available(now), 1000);
+        assert_eq!(limiter.take(500, now), None);
+        assert_eq!(limiter.available(now), 500);
+
+        // waiting for 1/10 of second transfer after all of them are taken
+        assert_eq!(limiter.take(500, now), Some(Duration::new(0, 100001000)));
+        assert_eq!(limiter.available(now + Duration::from_millis(250)), 250);
+    }
+
+    #[test]
+    fn big_chunk_is_paced() {
+        let now = Instant::now();
+        let mut limiter = RateLimiter::new(1000, now);
+
+        // 3 seconds of transfer at once, 2 of them should be waited back
+        let wait = limiter.take(3000, now).unwrap();
+        assert!(wait > Duration::from_millis(2100) && wait < Duration::from_millis(2110));
+        assert_eq!(limiter.available(now + Duration::from_secs(1)), 0);
+        assert!(limiter.available(now + wait) >= 100);
+    }
+
+    #[test]
+    fn idle_is_not_collecting_more_than_burst() {
+        let now = Instant::now();
+        let mut limiter = RateLimiter::new(1000, now);
+        assert_eq!(limiter.available(now + Duration::from_secs(60)), 1000);
+    }
+}
@@ -0,0 +1,163 @@
+#![allow(dead_code)]
+
+use helper::NetHelper;
+
+use std::collections::BTreeMap;
+
+const FNV_OFFSET_BASIS: u64 = 0xcbf29ce484222325;
+const FNV_PRIME: u64 = 0x100000001b3;
+
+/// Consistent hash ring for mapping keys to node tokens
+/// Each token is placed to the ring "replicas" times
+/// so keys are distributed evenly, and only keys of the added or removed token are moving
+pub struct HashRing {
+    ring: BTreeMap<u64, String>,
+    replicas: usize
+}
+
+impl HashRing {
+    pub fn new(replicas: usize) -> HashRing {
+        HashRing {
+            ring: BTreeMap::new(),
+            replicas: if replicas == 0 { 1 } else { replicas }
+        }
+    }
+
+    /// Stable identity hash for node token
+    /// Same token and salt are giving the same ID on every node and version
+    /// because hash is computed with FNV-1a, not with randomly seeded std hasher
+    /// It's not a cryptographic hash, different tokens could get the same ID
+    #[inline(always)]
+    pub fn node_id(token: &str, salt: &str) -> u64 {
+        // salt is prefixed with its length, so moving bytes
+        // between salt and token is giving different ID
+        let mut salt_len = vec![0u8; 8];
+        NetHelper::u64_to_bytes(salt.len() as u64, &mut salt_len, 0);
+
+        let mut hash = FNV_OFFSET_BASIS;
+        for b in salt_len.iter().chain(salt.as_bytes().iter()).chain(token.as_bytes().iter()) {
+            hash ^= *b as u64;
+            hash = hash.wrapping_mul(FNV_PRIME);
+        }
+
+        // FNV is not mixing last bytes well enough for similar tokens
+        // so finalizing it same way as MurmurHash3 for even ring distribution
+        hash ^= hash >> 33;
+        hash = hash.wrapping_mul(0xff51afd7ed558ccd);
+        hash ^= hash >> 33;
+        hash = hash.wrapping_mul(0xc4ceb9fe1a85ec53);
+        hash ^= hash >> 33;
+
+        hash
+    }
+
+    /// Adding token to the ring
+    pub fn add(&mut self, token: &str) {
+        for i in 0..self.replicas {
+            self.ring.insert(HashRing::node_id(token, format!("{}#", i).as_str()), String::from(token));
+        }
+    }
+
+    /// Removing token from the ring
+    pub fn remove(&mut self, token: &str) {
+        for i in 0..self.replicas {
+            let point = HashRing::node_id(token, format!("{}#", i).as_str());
+            // other token could have the same point, keeping it
+            let same = match self.ring.get(&point) {
+                Some(t) => t == token,
+                None => false
+            };
+
+            if same {
+                self.ring.remove(&point);
+            }
+        }
+    }
+
+    /// Getting token for given key
+    /// Returns None if ring is empty
+    pub fn get(&self, key: &str) -> Option<&String> {
+        let point = HashRing::node_id(key, "");
+        match self.ring.range(point..).next() {
+            Some((_, t)) => Some(t),
+            // going around the ring
+            None => self.ring.values().next()
+        }
+    }
+
+    #[inline(always)]
+    pub fn len(&self) -> usize {
+        self.ring.len() / self.replicas
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn ring_of(count: usize) -> HashRing {
+        let mut ring = HashRing::new(100);
+        for i in 0..count {
+            ring.add(format!("node-{}", i).as_str());
+        }
+        ring
+    }
+
+    fn mapping(ring: &HashRing) -> Vec<String> {
+        (0..1000).map(|k| ring.get(format!("key-{}", k).as_str()).unwrap().clone()).collect()
+    }
+
+    #[test]
+    fn stable_node_id() {
+        assert_eq!(HashRing::node_id("node-1", "salt"), HashRing::node_id("node-1", "salt"));
+        assert!(HashRing::node_id("node-1", "salt") != HashRing::node_id("node-1", "other"));
+        assert!(HashRing::node_id("node-1", "") != HashRing::node_id("node-2", ""));
+    }
+
+    #[test]
+    fn salt_is_separated_from_token() {
+        assert!(HashRing::node_id("bc", "a") != HashRing::node_id("c", "ab"));
+        assert!(HashRing::node_id("abc", "") != HashRing::node_id("", "abc"));
+    }
+
+    #[test]
+    fn stable_mapping() {
+        // same tokens added in different order are giving the same mapping
+        let mut reversed = HashRing::new(100);
+        for i in (0..5).rev() {
+            reversed.add(format!("node-{}", i).as_str());
+        }
+        assert_eq!(mapping(&ring_of(5)), mapping(&reversed));
+        assert_eq!(reversed.len(), 5);
+    }
+
+    #[test]
+    fn minimal_movement() {
+        let before = mapping(&ring_of(5));
+        let after = mapping(&ring_of(6));
+
+        // only keys which are moving to the new token are changed
+        let mut moved = 0;
+        for (b, a) in before.iter().zip(after.iter()) {
+            if b != a {
+                assert_eq!(a, "node-5");
+                moved += 1;
+            }
+        }
+        // roughly 1/6 of keys, with some space for uneven distribution
+        assert!(moved > 80 && moved < 280, "{} keys moved", moved);
+    }
+
+    #[test]
+    fn remove_token() {
+        let mut ring = ring_of(6);
+        ring.remove("node-5");
+        assert_eq!(mapping(&ring), mapping(&ring_of(5)));
+
+        let mut empty = HashRing::new(10);
+        assert!(empty.get("key").is_none());
+        empty.add("node");
+        empty.remove("node");
+        assert!(empty.get("key").is_none());
+    }
+}
@@ -3,7 +3,13 @@ extern crate  mio;
 
 use self::mio::Token;
 
+use std::collections::BTreeMap;
+use std::fmt;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicUsize, Ordering};
+
 use config::MAX_API_VERSION;
+use network::CONNECTION_CAPACITY_REASON;
 
 #[derive(Clone)]
 pub enum SocketType {
@@ -11,11 +17,108 @@ pub enum SocketType {
     TCP,
 }
 
+/// Reason why connection or one of its channels was closed
+#[derive(Clone, Debug, PartialEq)]
+pub enum CloseReason {
+    /// other side closed connection, with reason text if it sent one
+    Remote(String),
+    /// this Node closed connection and other side acknowledged it by closing its side
+    Local,
+    /// this Node closed connection, but other side didn't close its side during close timeout
+    CloseTimeout,
+    /// socket level error
+    Error(String),
+    /// other side sent invalid handshake or data
+    Protocol(String),
+    /// connection was rejected because of connections limit
+    Capacity,
+    /// nothing was read from connection during read timeout
+    ReadTimeout,
+    /// queued data was not written to connection during write timeout
+    WriteTimeout,
+    /// client connection didn't finish handshake before connect deadline
+    ConnectTimeout,
+}
+
+impl CloseReason {
+    /// Making reason from close event text sent by other side
+    #[inline(always)]
+    pub fn from_remote(reason: &str) -> CloseReason {
+        if reason == CONNECTION_CAPACITY_REASON {
+            return CloseReason::Capacity;
+        }
+
+        CloseReason::Remote(String::from(reason))
+    }
+}
+
+impl fmt::Display for CloseReason {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match *self {
+            CloseReason::Remote(ref r) => if r.len() > 0 { write!(f, "Closed by remote side -> {}", r) } else { write!(f, "Closed by remote side") },
+            CloseReason::Local => write!(f, "Closed by this Node"),
+            CloseReason::CloseTimeout => write!(f, "Closed by this Node without acknowledgement"),
+            CloseReason::Error(ref e) => write!(f, "Connection error -> {}", e),
+            CloseReason::Protocol(ref e) => write!(f, "Protocol error -> {}", e),
+            CloseReason::Capacity => write!(f, "Rejected because of connections limit"),
+            CloseReason::ReadTimeout => write!(f, "Nothing was read during read timeout"),
+            CloseReason::WriteTimeout => write!(f, "Queued data was not written during write timeout"),
+            CloseReason::ConnectTimeout => write!(f, "Handshake was not done before connect deadline"),
+        }
+    }
+}
+
+/// Bytes read from and written to single channel
+/// TcpHandler is counting them, while Networking could read them for open channel
+pub struct ByteCounters {
+    read: AtomicUsize,
+    written: AtomicUsize
+}
+
+impl ByteCounters {
+    #[inline(always)]
+    pub fn new() -> ByteCounters {
+        ByteCounters {
+            read: AtomicUsize::new(0),
+            written: AtomicUsize::new(0)
+        }
+    }
+
+    #[inline(always)]
+    pub fn add_read(&self, bytes: usize) {
+        self.read.fetch_add(bytes, Ordering::Relaxed);
+    }
+
+    #[inline(always)]
+    pub fn add_written(&self, bytes: usize) {
+        self.written.fetch_add(bytes, Ordering::Relaxed);
+    }
+
+    /// Getting bytes read and written
+    #[inline(always)]
+    pub fn get(&self) -> (u64, u64) {
+        (self.read.load(Ordering::Relaxed) as u64, self.written.load(Ordering::Relaxed) as u64)
+    }
+}
+
 #[derive(Clone)]
 pub struct ConnectionIdentity {
     pub handler_index: usize,
     pub socket_type: SocketType,
-    pub socket_token: Token
+    pub socket_token: Token,
+    // TcpHandler is reusing slots of closed connections for socket tokens
+    // so generation is telling apart connections which had the same token
+    pub generation: u64
+}
+
+impl ConnectionIdentity {
+    /// Checking if this is identity of the same channel
+    #[inline(always)]
+    pub fn is_same(&self, other: &ConnectionIdentity) -> bool {
+        self.handler_index == other.handler_index
+            && self.socket_token == other.socket_token
+            && self.generation == other.generation
+    }
 }
 
 pub struct Connection {
@@ -32,7 +135,23 @@ pub struct Connection {
 
     /// index for making round rubin for writing data
     /// over identities for this connection
-    identity_index: usize
+    identity_index: usize,
+
+    /// custom application data attached to this connection
+    /// it would be dropped together with connection after close
+    metadata: BTreeMap<String, Vec<u8>>,
+
+    /// close reason which other side sent with close event
+    /// used for channels closed by other side after that
+    pub remote_close_reason: Option<CloseReason>,
+
+    /// total bytes read from and written to already closed channels
+    /// TcpHandler is reporting them when channel is closed
+    pub bytes_read: u64,
+    pub bytes_written: u64,
+
+    /// byte counters of open channels, removed together with their identity
+    traffic: Vec<(ConnectionIdentity, Arc<ByteCounters>)>
 }
 
 impl Connection {
@@ -44,7 +163,12 @@ impl Connection {
             token: token,
             value: value,
             identities: vec![identity],
-            identity_index: 0
+            identity_index: 0,
+            metadata: BTreeMap::new(),
+            remote_close_reason: None,
+            bytes_read: 0,
+            bytes_written: 0,
+            traffic: vec![]
         }
     }
 
@@ -53,10 +177,30 @@ impl Connection {
         self.identities.push(identity);
     }
 
+    /// Attaching live byte counters of the channel with given identity
     #[inline(always)]
-    pub fn rm_identity(&mut self, socket_token: Token, index: usize) {
+    pub fn add_traffic(&mut self, identity: ConnectionIdentity, counters: Arc<ByteCounters>) {
+        self.traffic.push((identity, counters));
+    }
+
+    /// Getting total bytes read and written by all channels of this connection
+    /// including channels which are still open
+    pub fn total_bytes(&self) -> (u64, u64) {
+        let mut total = (self.bytes_read, self.bytes_written);
+        for &(_, ref counters) in &self.traffic {
+            let (read, written) = counters.get();
+            total.0 += read;
+            total.1 += written;
+        }
+        total
+    }
+
+    #[inline(always)]
+    pub fn rm_identity(&mut self, identity: &ConnectionIdentity) {
+        // closed channel totals are reported with close command
+        self.traffic.retain(|&(ref i, _)| !i.is_same(identity));
         for i in 0..self.identities.len() {
-            if self.identities[i].handler_index == index && self.identities[i].socket_token == socket_token {
+            if self.identities[i].is_same(identity) {
                 self.identities.remove(i);
                 return;
             }
@@ -68,6 +212,11 @@ impl Connection {
         self.identities.len()
     }
 
+    #[inline(always)]
+    pub fn identities(&self) -> &Vec<ConnectionIdentity> {
+        &self.identities
+    }
+
     pub fn get_identity(&mut self) -> ConnectionIdentity {
         if self.identity_index >= self.identities.len() {
             self.identity_index = 0;
@@ -78,9 +227,98 @@ impl Connection {
         self.identities[i].clone()
     }
 
+    /// Getting custom metadata value attached to this connection
+    #[inline(always)]
+    pub fn get_meta(&self, key: &str) -> Option<&Vec<u8>> {
+        self.metadata.get(key)
+    }
+
+    /// Attaching custom metadata value to this connection
+    /// Returns previous value if key already existed
+    #[inline(always)]
+    pub fn set_meta(&mut self, key: &str, value: Vec<u8>) -> Option<Vec<u8>> {
+        self.metadata.insert(String::from(key), value)
+    }
+
+    /// Deleting custom metadata value from this connection
+    #[inline(always)]
+    pub fn rm_meta(&mut self, key: &str) -> Option<Vec<u8>> {
+        self.metadata.remove(key)
+    }
+
     /// Checking API version, if it's not correct function will return false
+    /// version should match expected one, if expected is 0 any supported version is fine
     #[inline(always)]
-    pub fn check_api_version(version: u32) -> bool {
-        version > 0 && version < MAX_API_VERSION
+    pub fn check_api_version(version: u32, expected: u32) -> bool {
+        version > 0 && version < MAX_API_VERSION && (expected == 0 || version == expected)
     }
-}
\ No newline at end of file
+}
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn remote_reason_from_close_event() {
+        assert_eq!(CloseReason::from_remote("maintenance"), CloseReason::Remote(String::from("maintenance")));
+        assert_eq!(CloseReason::from_remote(""), CloseReason::Remote(String::new()));
+        assert_eq!(CloseReason::from_remote(CONNECTION_CAPACITY_REASON), CloseReason::Capacity);
+    }
+
+    #[test]
+    fn reasons_are_printed_differently() {
+        let reasons = vec![CloseReason::Remote(String::new()), CloseReason::Remote(String::from("bye")),
+                           CloseReason::Local, CloseReason::CloseTimeout, CloseReason::Error(String::from("reset")),
+                           CloseReason::Protocol(String::from("bad")), CloseReason::Capacity,
+                           CloseReason::ReadTimeout, CloseReason::WriteTimeout, CloseReason::ConnectTimeout];
+        let texts: Vec<String> = reasons.iter().map(|r| format!("{}", r)).collect();
+        for (i, text) in texts.iter().enumerate() {
+            assert!(texts.iter().skip(i + 1).all(|t| t != text), "{} is not unique", text);
+        }
+        assert_eq!(texts[1], "Closed by remote side -> bye");
+    }
+
+    fn connection() -> Connection {
+        Connection::new(String::from("child"), 3, ConnectionIdentity {
+            handler_index: 0,
+            socket_type: SocketType::TCP,
+            socket_token: Token(1),
+            generation: 1
+        })
+    }
+
+    #[test]
+    fn meta_set_get_rm() {
+        let mut conn = connection();
+        assert!(conn.get_meta("region").is_none());
+
+        assert_eq!(conn.set_meta("region", vec![1]), None);
+        assert_eq!(conn.get_meta("region"), Some(&vec![1]));
+
+        // setting existing key is replacing value and giving back the previous one
+        assert_eq!(conn.set_meta("region", vec![2, 3]), Some(vec![1]));
+        assert_eq!(conn.get_meta("region"), Some(&vec![2, 3]));
+
+        assert_eq!(conn.rm_meta("region"), Some(vec![2, 3]));
+        assert!(conn.get_meta("region").is_none());
+        assert_eq!(conn.rm_meta("region"), None);
+    }
+
+    #[test]
+    fn meta_keys_are_separate() {
+        let mut conn = connection();
+        conn.set_meta("a", vec![1]);
+        conn.set_meta("b", vec![2]);
+        conn.rm_meta("a");
+        assert!(conn.get_meta("a").is_none());
+        assert_eq!(conn.get_meta("b"), Some(&vec![2]));
+    }
+
+    #[test]
+    fn api_version_should_match() {
+        assert!(Connection::check_api_version(2, 2));
+        assert!(!Connection::check_api_version(1, 2));
+        assert!(Connection::check_api_version(1, 0));
+        assert!(!Connection::check_api_version(0, 0));
+        assert!(!Connection::check_api_version(MAX_API_VERSION, 0));
+    }
+}
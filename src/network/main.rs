@@ -4,19 +4,63 @@ extern crate mio;
 use self::mio::{Ready, PollOpt, Token};
 
 use node::{Node, NET_RECEIVER_CHANNEL_TOKEN};
-use network::{ConnectionIdentity, Connection, TcpNetwork, SocketType, TcpHandlerCommand, TcpHandlerCMD};
-use helper::{Log, NetHelper};
-use event::{Event};
+use network::{ConnectionIdentity, Connection, CloseReason, ByteCounters, TcpNetwork, SocketType, TcpHandlerCommand, TcpHandlerCMD
+              , CONNECTION_CLOSE_EVENT, CONNECTION_CAPACITY_REASON, PARENT_LOST_EVENT
+              , CONNECTION_MANIFEST_REASON, PARENT_BUFFER_SIZE};
+use helper::{Log, NetHelper, Path};
+use event::{Event, TapDirection};
 
 use std::error::Error;
 use std::process;
 use std::sync::Arc;
+use std::sync::atomic::Ordering;
+use std::net::SocketAddr;
+use std::str::FromStr;
+
+/// What to do with API connections when parent connection is lost
+#[derive(Clone, Copy, PartialEq)]
+pub enum ParentLossPolicy {
+    // keeping API connections as is, events for the parent are buffered
+    // until parent connection is made again
+    Keep,
+    // sending PARENT_LOST_EVENT to API connections
+    Notify,
+    // closing API connections
+    Disconnect
+}
+
+/// Decision of the forward filter for received event
+#[derive(Clone, Copy, PartialEq)]
+pub enum ForwardDecision {
+    // handling event and forwarding it based on path
+    Forward,
+    // only handling event by this Node
+    Local,
+    // ignoring event
+    Drop
+}
+
+/// Callback for deciding what to do with received event before handling and forwarding it
+pub type ForwardFilter = Box<Fn(&Event) -> ForwardDecision>;
+
+/// Counters of events mirrored to standby connection
+/// missed and dropped events are the lag which standby is never going to get
+#[derive(Clone, Copy, Debug)]
+pub struct MirrorStats {
+    // events queued for sending to standby
+    pub sent: u64,
+    // events which were not sent because standby was not connected
+    pub missed: u64,
+    // events dropped by TcpHandler because standby was not reading fast enough
+    pub dropped: u64
+}
 
 pub enum NetworkCMD {
     None,
     ConnectionClose,
     HandleConnection,
-    HandleEvent
+    HandleEvent,
+    HandshakeFailed
 }
 
 pub struct NetworkCommand {
@@ -24,7 +68,16 @@ pub struct NetworkCommand {
     pub token: Vec<String>,
     pub value: Vec<u64>,
     pub conn_identity: Vec<ConnectionIdentity>,
-    pub event: Vec<Event>
+    pub event: Vec<Event>,
+    // reasons of closing connections
+    pub close_reason: Vec<CloseReason>,
+    // remote addresses of connections which failed handshake
+    // or address which we connected to for new client connections
+    pub address: Vec<SocketAddr>,
+    // bytes read from and written to closed channels
+    pub bytes: Vec<(u64, u64)>,
+    // live byte counters of new channels
+    pub traffic: Vec<Arc<ByteCounters>>
 }
 
 pub trait Networking {
@@ -41,7 +94,72 @@ pub trait Networking {
     fn net_ready(&mut self, token: Token, event_kind: Ready) -> bool;
 
     /// sending event with specific path
+    /// events made by this Node are getting unique ID if they don't have it
     fn emit(&mut self, event: Event);
+
+    /// Sending command to TcpHandlers for all channels of connection with given token
+    /// Returns false if there is no connection with this token
+    fn connection_command(&mut self, token: &String, cmd: TcpHandlerCMD, data: Vec<Arc<Vec<u8>>>) -> bool;
+
+    /// Sending event to all channels of connection with given token
+    /// with "WriteData", "MirrorData" or "CloseConnection" command, event is given to taps before sending
+    /// Returns false if there is no connection with this token or event can't be encoded
+    fn send_event(&mut self, token: &String, cmd: TcpHandlerCMD, event: &Event) -> bool;
+
+    /// Stopping to read data from all channels of connection with given token
+    /// without closing it, other side would be blocked by TCP flow control
+    fn pause_reading(&mut self, token: &String) -> bool;
+
+    /// Starting to read again from connection paused by "pause_reading"
+    fn resume_reading(&mut self, token: &String) -> bool;
+
+    /// Limiting bytes per second for reading from and writing to connection with given token
+    /// instead of limits configured for its type, 0 is unlimited
+    /// Returns false if there is no connection with this token
+    fn set_rate_limit(&mut self, token: &String, read_rate: u64, write_rate: u64) -> bool;
+
+    /// Closing all channels of connection with given token
+    /// other side would get close event with given reason before closing
+    /// and it acknowledges close by closing its side, then reason is "Local"
+    /// without acknowledgement during close timeout it's "CloseTimeout"
+    /// Returns false if there is no connection with this token
+    fn close_with_reason(&mut self, token: &String, reason: &str) -> bool;
+
+    /// Evicting child Node connection with given token
+    /// same as "close_with_reason", but only for connected children
+    /// Returns error if there is no such child connected
+    fn disconnect(&mut self, token: &String, reason: &str) -> Result<(), String>;
+
+    /// Setting filter which would be called for each received event
+    /// after dropping duplicates
+    fn set_forward_filter(&mut self, filter: ForwardFilter);
+
+    /// Closing channel which is not yet added to connections
+    /// other side would get close event with given reason before closing
+    fn reject_connection(&mut self, token: &String, identity: &ConnectionIdentity, reason: &str);
+
+    /// Sending copy of received event to standby connection if it's configured
+    /// copy has empty path, so standby is not forwarding it anywhere
+    fn mirror_event(&mut self, from_token: &String, event: &Event);
+
+    /// Getting counters of events mirrored to standby connection
+    fn mirror_stats(&self) -> MirrorStats;
+
+    /// Applying ParentLossPolicy to API connections after parent connection with given value is closed
+    fn handle_parent_loss(&mut self, value: u64);
+
+    /// Keeping event which should go to the lost parent, if "keep" policy is buffering them
+    fn buffer_for_parent(&mut self, event: &mut Event);
+
+    /// Sending events kept while parent was lost to the new parent connection
+    fn flush_parent_buffer(&mut self, token: &String);
+
+    /// Encoding event with configured codec and framing it with 4 bytes BigEndian length
+    /// for writing it to connections
+    fn encode_event(&self, event: &Event) -> Option<Arc<Vec<u8>>>;
+
+    /// Making close event with given reason for connection with given token
+    fn close_event(&mut self, token: &String, reason: &str) -> Event;
 }
 
 
@@ -53,7 +171,11 @@ impl NetworkCommand {
             token: vec![],
             value: vec![],
             conn_identity: vec![],
-            event: vec![]
+            event: vec![],
+            close_reason: vec![],
+            address: vec![],
+            bytes: vec![],
+            traffic: vec![]
         }
     }
 }
@@ -74,9 +196,57 @@ impl Networking for Node {
                 let token = command.token.remove(0);
                 let identity = command.conn_identity.remove(0);
                 let value = command.value.remove(0);
+                let traffic = command.traffic.pop();
 
                 if !self.connections.contains_key(&token) {
-                    self.connections.insert(token.clone(), Connection::new(token.clone(), value, identity));
+                    // checking if this is connection which we made to the parent address
+                    let mut is_parent = false;
+                    if command.address.len() > 0 && !self.is_root() {
+                        if let Ok(parent) = SocketAddr::from_str(self.parent_address.as_str()) {
+                            is_parent = command.address[0] == parent;
+                        }
+                    }
+
+                    // new connection should fit into limit for its type
+                    // API connections are limited separately from children
+                    // and parent and mirror standby connections are not limited at all
+                    let limit = if value == 0 { self.net_max_api_connections } else { self.net_max_connections };
+                    let parent_token = self.parent_token.clone();
+                    let is_mirror = token == self.net_mirror_token;
+                    if !is_parent && !is_mirror && limit > 0 && self.connections.values()
+                        .filter(|c| (c.value == 0) == (value == 0)
+                                && parent_token.as_ref() != Some(&c.token)
+                                && c.token != self.net_mirror_token)
+                        .count() >= limit {
+                        Log::warn("Connections limit reached, rejecting connection", NetHelper::escape_token(&token).as_str());
+                        self.reject_connection(&token, &identity, CONNECTION_CAPACITY_REASON);
+                        return;
+                    }
+
+                    // Node connections should be listed in topology manifest if we have it
+                    let allowed = match self.net_manifest {
+                        Some(ref m) => value == 0 || m.allows(&token, is_parent),
+                        None => true
+                    };
+                    if !allowed {
+                        Log::warn("Connection is not listed in topology manifest, rejecting connection", NetHelper::escape_token(&token).as_str());
+                        self.reject_connection(&token, &identity, CONNECTION_MANIFEST_REASON);
+                        return;
+                    }
+
+                    let mut conn = Connection::new(token.clone(), value, identity.clone());
+                    if let Some(counters) = traffic {
+                        conn.add_traffic(identity, counters);
+                    }
+                    self.connections.insert(token.clone(), conn);
+
+                    // keeping parent token for readiness check
+                    if is_parent {
+                        self.parent_token = Some(token.clone());
+                        self.update_ready();
+                        self.flush_parent_buffer(&token);
+                    }
+
                     // if we have API connection
                     if value == 0 {
                         self.on_new_api_connection(&token);
@@ -87,6 +257,9 @@ impl Networking for Node {
                     // adding connection identity
                     match self.connections.get_mut(&token) {
                         Some(conn) => {
+                            if let Some(counters) = traffic {
+                                conn.add_traffic(identity.clone(), counters);
+                            }
                             conn.add_identity(identity);
                         }
                         None => {}
@@ -105,9 +278,28 @@ impl Networking for Node {
 
                 let token = command.token.remove(0);
                 let identity = command.conn_identity.remove(0);
+                let mut close_reason = if command.close_reason.len() > 0 {
+                    command.close_reason.remove(0)
+                } else {
+                    CloseReason::Remote(String::new())
+                };
+                let (bytes_read, bytes_written) = if command.bytes.len() > 0 {
+                    command.bytes.remove(0)
+                } else {
+                    (0, 0)
+                };
                 let remove_conn = match self.connections.get_mut(&token) {
                     Some(conn) => {
-                        conn.rm_identity(identity.socket_token, identity.handler_index);
+                        conn.rm_identity(&identity);
+                        conn.bytes_read += bytes_read;
+                        conn.bytes_written += bytes_written;
+                        // if other side told us why it is closing
+                        // using that instead of plain remote close
+                        if close_reason == CloseReason::Remote(String::new()) {
+                            if let Some(ref r) = conn.remote_close_reason {
+                                close_reason = r.clone();
+                            }
+                        }
                         // if identity count is 0, we need to close connection
                         conn.identity_count() == 0
                     },
@@ -115,36 +307,105 @@ impl Networking for Node {
                 };
 
                 // anyway we need to close channel of this connection
-                self.on_connection_channel_close(&token);
+                self.on_connection_channel_close(&token, &close_reason);
 
                 // if we need to close full connection
                 // letting node know about it
                 if remove_conn {
-                    self.on_connection_close(&token);
+                    let parent_lost = self.parent_token.as_ref() == Some(&token);
+                    let parent_value = match self.connections.get(&token) {
+                        Some(conn) => conn.value,
+                        None => 0
+                    };
+                    if parent_lost {
+                        self.parent_token = None;
+                        self.update_ready();
+                    }
+                    self.on_connection_close(&token, &close_reason);
                     self.connections.remove(&token);
+                    if parent_lost {
+                        self.on_parent_disconnected(&token, &close_reason);
+                        self.handle_parent_loss(parent_value);
+                    }
                 }
             }
 
             NetworkCMD::HandleEvent => {
                 // currently supporting only one connection per single command request
-                if command.token.len() != 1 {
+                if command.token.len() != 1 || command.conn_identity.len() != 1 {
                     return;
                 }
 
                 // getting token out
                 let token = command.token.remove(0);
+                let identity = command.conn_identity.remove(0);
 
+                // connection could be rejected by limits or manifest, but it could send events
+                // before TcpHandler closed it, ignoring them completely
+                let accepted = match self.connections.get(&token) {
+                    Some(conn) => conn.identities().iter().any(|i| i.is_same(&identity)),
+                    None => false
+                };
+                if !accepted {
+                    return;
+                }
+
+                let tokens = vec![token.clone()];
                 while !command.event.is_empty() {
                     let event = command.event.remove(0);
+                    self.tap_event(TapDirection::Inbound, &tokens, &event);
+
+                    // other side is closing this connection
+                    // so just keeping the reason why
+                    if event.name == CONNECTION_CLOSE_EVENT {
+                        let reason = String::from_utf8_lossy(event.data.as_slice()).into_owned();
+                        Log::info(format!("Connection {} is closing by remote side", NetHelper::escape_token(&token)).as_str()
+                                  , reason.as_str());
+                        if let Some(conn) = self.connections.get_mut(&token) {
+                            conn.remote_close_reason = Some(CloseReason::from_remote(reason.as_str()));
+                        }
+                        continue;
+                    }
+
+                    // same event could come twice from different paths
+                    if !self.event_dedup.check(&event.from, event.id) {
+                        continue;
+                    }
+
+                    let decision = match self.net_forward_filter {
+                        Some(ref filter) => filter(&event),
+                        None => ForwardDecision::Forward
+                    };
+
+                    if decision == ForwardDecision::Drop {
+                        continue;
+                    }
+
+                    self.deliver_event(&token, &event);
+                    self.mirror_event(&token, &event);
+
                     // if event processing passing fine
                     // emitting event based on his path
-                    if self.on_event_data(&token, &event) && !event.path.is_zero() {
+                    if self.on_event_data(&token, &event) && decision == ForwardDecision::Forward && !event.path.is_zero() {
                         // then trying to send event over available connections
                         self.emit(event);
                     }
                 }
             }
 
+            NetworkCMD::HandshakeFailed => {
+                while !command.address.is_empty() {
+                    let address = command.address.remove(0);
+                    if !command.close_reason.is_empty() {
+                        Log::info("Rejected connection handshake", format!("{} -> {}", address, command.close_reason.remove(0)).as_str());
+                    }
+                    if self.net_tcp_handshake_guard.failed(address.ip()) {
+                        Log::warn("Too many failed handshakes, blocking connections from IP"
+                                  , format!("{}", address.ip()).as_str());
+                    }
+                }
+            }
+
             NetworkCMD::None => {}
         }
     }
@@ -208,10 +469,16 @@ impl Networking for Node {
 
     #[inline(always)]
     fn emit(&mut self, event: Event) {
-        let mut tcp_conns_to_send: Vec<Vec<Token>> = vec![Vec::new(); self.net_tcp_handler_sender_chan.len()];
+        let mut tcp_conns_to_send: Vec<Vec<ConnectionIdentity>> = vec![Vec::new(); self.net_tcp_handler_sender_chan.len()];
+        let mut sent_tokens: Vec<String> = vec![];
         let mut event = event;
+        if event.id == 0 && event.from == self.token {
+            event.id = self.make_event_id();
+        }
+
         for (_, mut conn) in &mut self.connections {
-            if conn.value == 0 {
+            // mirror standby is getting only mirrored copies
+            if conn.value == 0 || conn.token == self.net_mirror_token {
                 continue;
             }
 
@@ -222,24 +489,29 @@ impl Networking for Node {
             // if we trying to send to this connection
             // removing it from path
             event.path.div(conn.value);
+            sent_tokens.push(conn.token.clone());
             let identity = conn.get_identity();
             match identity.socket_type {
                 SocketType::TCP => {
-                    tcp_conns_to_send[identity.handler_index].push(identity.socket_token);
+                    tcp_conns_to_send[identity.handler_index].push(identity);
                 }
 
                 SocketType::NONE => {}
             }
         }
 
-        if tcp_conns_to_send.len() == 0 {
+        self.buffer_for_parent(&mut event);
+
+        if sent_tokens.len() == 0 {
             return;
         }
 
-        let data = Arc::new(match event.to_raw() {
+        self.tap_event(TapDirection::Outbound, &sent_tokens, &event);
+
+        let data = match self.encode_event(&event) {
             Some(d) => d,
             None => return
-        });
+        };
 
         for i in 0..self.net_tcp_handler_sender_chan.len() {
             if tcp_conns_to_send[i].len() == 0 {
@@ -248,7 +520,9 @@ impl Networking for Node {
 
             let mut command = TcpHandlerCommand::new();
             command.cmd = TcpHandlerCMD::WriteData;
-            command.token = tcp_conns_to_send[i].clone();
+            for identity in &tcp_conns_to_send[i] {
+                command.add_identity(identity);
+            }
             command.data = vec![data.clone()];
             match self.net_tcp_handler_sender_chan[i].send(command) {
                 Ok(_) => {},
@@ -258,4 +532,628 @@ impl Networking for Node {
             }
         }
     }
-}
\ No newline at end of file
+
+    fn connection_command(&mut self, token: &String, cmd: TcpHandlerCMD, data: Vec<Arc<Vec<u8>>>) -> bool {
+        let identities = match self.connections.get(token) {
+            Some(conn) => conn.identities().clone(),
+            None => return false
+        };
+
+        let mut tcp_conns: Vec<Vec<ConnectionIdentity>> = vec![Vec::new(); self.net_tcp_handler_sender_chan.len()];
+        for identity in identities {
+            match identity.socket_type {
+                SocketType::TCP => {
+                    tcp_conns[identity.handler_index].push(identity);
+                }
+
+                SocketType::NONE => {}
+            }
+        }
+
+        for i in 0..self.net_tcp_handler_sender_chan.len() {
+            if tcp_conns[i].len() == 0 {
+                continue;
+            }
+
+            let mut command = TcpHandlerCommand::new();
+            command.cmd = cmd;
+            for identity in &tcp_conns[i] {
+                command.add_identity(identity);
+            }
+            command.data = data.clone();
+            match self.net_tcp_handler_sender_chan[i].send(command) {
+                Ok(_) => {},
+                Err(e) => {
+                    Log::error("Unable to send connection command to TcpHandler", e.description());
+                }
+            }
+        }
+
+        true
+    }
+
+    fn send_event(&mut self, token: &String, cmd: TcpHandlerCMD, event: &Event) -> bool {
+        if !self.connections.contains_key(token) {
+            return false;
+        }
+
+        let data = match self.encode_event(event) {
+            Some(d) => d,
+            None => return false
+        };
+
+        self.tap_event(TapDirection::Outbound, &vec![token.clone()], event);
+        self.connection_command(token, cmd, vec![data])
+    }
+
+    #[inline(always)]
+    fn pause_reading(&mut self, token: &String) -> bool {
+        self.connection_command(token, TcpHandlerCMD::PauseReading, vec![])
+    }
+
+    #[inline(always)]
+    fn resume_reading(&mut self, token: &String) -> bool {
+        self.connection_command(token, TcpHandlerCMD::ResumeReading, vec![])
+    }
+
+    fn set_rate_limit(&mut self, token: &String, read_rate: u64, write_rate: u64) -> bool {
+        let mut data = vec![0; 16];
+        NetHelper::u64_to_bytes(read_rate, &mut data, 0);
+        NetHelper::u64_to_bytes(write_rate, &mut data, 8);
+        self.connection_command(token, TcpHandlerCMD::SetRateLimit, vec![Arc::new(data)])
+    }
+
+    fn close_with_reason(&mut self, token: &String, reason: &str) -> bool {
+        if !self.connections.contains_key(token) {
+            return false;
+        }
+
+        // close event with reason would be written
+        // before closing each channel of connection
+        let event = self.close_event(token, reason);
+
+        // connection would be removed after getting ConnectionClose command
+        // from TcpHandler, so on_connection_close would be called as usual
+        self.send_event(token, TcpHandlerCMD::CloseConnection, &event)
+    }
+
+    fn disconnect(&mut self, token: &String, reason: &str) -> Result<(), String> {
+        let is_child = match self.connections.get(token) {
+            Some(conn) => conn.value != 0 && self.parent_token.as_ref() != Some(token),
+            None => false
+        };
+
+        if !is_child || !self.close_with_reason(token, reason) {
+            return Err(format!("Child {} is not connected", NetHelper::escape_token(token)));
+        }
+
+        Ok(())
+    }
+
+    fn reject_connection(&mut self, token: &String, identity: &ConnectionIdentity, reason: &str) {
+        let event = self.close_event(token, reason);
+        let data = match self.encode_event(&event) {
+            Some(d) => d,
+            None => return
+        };
+
+        // rejected connection is not in connections list
+        // so it's not possible to use "send_event" for it
+        self.tap_event(TapDirection::Outbound, &vec![token.clone()], &event);
+
+        match identity.socket_type {
+            SocketType::TCP => {
+                let mut command = TcpHandlerCommand::new();
+                command.cmd = TcpHandlerCMD::CloseConnection;
+                command.add_identity(identity);
+                command.data = vec![data];
+                match self.net_tcp_handler_sender_chan[identity.handler_index].send(command) {
+                    Ok(_) => {},
+                    Err(e) => {
+                        Log::error("Unable to send connection command to TcpHandler", e.description());
+                    }
+                }
+            }
+
+            SocketType::NONE => {}
+        }
+    }
+
+    #[inline(always)]
+    fn set_forward_filter(&mut self, filter: ForwardFilter) {
+        self.net_forward_filter = Some(filter);
+    }
+
+    fn mirror_event(&mut self, from_token: &String, event: &Event) {
+        if self.net_mirror_token.len() == 0 || &self.net_mirror_token == from_token {
+            return;
+        }
+
+        if !self.connections.contains_key(&self.net_mirror_token) {
+            self.net_mirror_missed += 1;
+            return;
+        }
+
+        let mut mirrored = event.clone();
+        mirrored.path = Path::new();
+
+        // this is only queueing data for TcpHandler
+        // so slow standby is not blocking this Node
+        let mirror_token = self.net_mirror_token.clone();
+        if self.send_event(&mirror_token, TcpHandlerCMD::MirrorData, &mirrored) {
+            self.net_mirror_sent += 1;
+        }
+    }
+
+    #[inline(always)]
+    fn mirror_stats(&self) -> MirrorStats {
+        MirrorStats {
+            sent: self.net_mirror_sent,
+            missed: self.net_mirror_missed,
+            dropped: self.net_tcp_handler_config.mirror_dropped.load(Ordering::Relaxed) as u64
+        }
+    }
+
+    fn handle_parent_loss(&mut self, value: u64) {
+        if self.net_parent_loss_policy == ParentLossPolicy::Keep {
+            // Node is not reconnecting by itself, so events are kept
+            // until parent connection is made again with "tcp_connect"
+            self.net_lost_parent_value = value;
+            return;
+        }
+
+        let api_tokens: Vec<String> = self.connections.values()
+            .filter(|c| c.value == 0)
+            .map(|c| c.token.clone())
+            .collect();
+        if api_tokens.len() == 0 {
+            return;
+        }
+
+        match self.net_parent_loss_policy {
+            ParentLossPolicy::Notify => {
+                let mut event = Event::default();
+                event.name = String::from(PARENT_LOST_EVENT);
+                event.from = self.token.clone();
+                event.id = self.make_event_id();
+                for token in &api_tokens {
+                    self.send_event(token, TcpHandlerCMD::WriteData, &event);
+                }
+            }
+
+            ParentLossPolicy::Disconnect => {
+                for token in &api_tokens {
+                    self.close_with_reason(token, "parent connection lost");
+                }
+            }
+
+            ParentLossPolicy::Keep => {}
+        }
+    }
+
+    fn buffer_for_parent(&mut self, event: &mut Event) {
+        let value = self.net_lost_parent_value;
+        if value == 0 || !event.path.dividable(value) {
+            return;
+        }
+
+        // removing parent from path like it was sent to it
+        event.path.div(value);
+        if self.net_parent_buffer.len() >= PARENT_BUFFER_SIZE {
+            if self.net_parent_buffer_dropped == 0 {
+                Log::warn("Parent buffer is full, dropping oldest events", NetHelper::escape_token(&event.name).as_str());
+            }
+            self.net_parent_buffer.pop_front();
+            self.net_parent_buffer_dropped += 1;
+        }
+        self.net_parent_buffer.push_back(event.clone());
+    }
+
+    fn flush_parent_buffer(&mut self, token: &String) {
+        self.net_lost_parent_value = 0;
+        if self.net_parent_buffer_dropped > 0 {
+            Log::info("Events dropped while parent was lost", format!("{}", self.net_parent_buffer_dropped).as_str());
+            self.net_parent_buffer_dropped = 0;
+        }
+
+        while let Some(event) = self.net_parent_buffer.pop_front() {
+            self.send_event(token, TcpHandlerCMD::WriteData, &event);
+        }
+    }
+
+    fn close_event(&mut self, token: &String, reason: &str) -> Event {
+        let mut event = Event::default();
+        event.id = self.make_event_id();
+        event.name = String::from(CONNECTION_CLOSE_EVENT);
+        event.from = self.token.clone();
+        event.target = token.clone();
+        event.data = Vec::from(reason.as_bytes());
+        event
+    }
+
+    fn encode_event(&self, event: &Event) -> Option<Arc<Vec<u8>>> {
+        let mut data: Vec<u8> = vec![];
+        match event.write_to(&*self.net_tcp_handler_config.codec, &mut data) {
+            Ok(_) => Some(Arc::new(data)),
+            Err(e) => {
+                Log::warn("Unable to encode event for sending it", e.description());
+                None
+            }
+        }
+    }
+}
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use node::testing::{self, Peer};
+    use std::net::{Shutdown, TcpListener};
+    use std::io::Write;
+    use std::time::Duration;
+
+    fn closed_reason(node: &Node, token: &str) -> Option<CloseReason> {
+        node.closed_connections.iter()
+            .find(|&&(ref t, _)| t == token)
+            .map(|&(_, ref r)| r.clone())
+    }
+
+    #[test]
+    fn disconnect_acknowledged_by_child() {
+        let mut node = testing::node(&[]);
+        let mut child = Peer::connect(&mut node, "child", 3);
+
+        assert!(node.disconnect(&String::from("child"), "evicted").is_ok());
+        assert_eq!(child.read_close(), Some(String::from("evicted")));
+
+        // child acknowledges close by closing its side
+        child.stream.shutdown(Shutdown::Write).unwrap();
+        testing::run_until(&mut node, |n| closed_reason(n, "child").is_some());
+        assert_eq!(closed_reason(&node, "child"), Some(CloseReason::Local));
+        assert!(!node.connections.contains_key("child"));
+        assert!(child.is_closed());
+    }
+
+    #[test]
+    fn disconnect_closed_after_timeout() {
+        let mut node = testing::node(&[("close_timeout", "1")]);
+        let mut child = Peer::connect(&mut node, "child", 3);
+
+        assert!(node.disconnect(&String::from("child"), "evicted").is_ok());
+        assert_eq!(child.read_close(), Some(String::from("evicted")));
+
+        // child is keeping connection open, so Node closes it after close timeout
+        testing::run_until(&mut node, |n| closed_reason(n, "child").is_some());
+        assert_eq!(closed_reason(&node, "child"), Some(CloseReason::CloseTimeout));
+        assert!(child.is_closed());
+    }
+
+    #[test]
+    fn disconnect_only_connected_children() {
+        let mut node = testing::node(&[]);
+        let _api = Peer::connect(&mut node, "api", 0);
+
+        assert!(node.disconnect(&String::from("missing"), "evicted").is_err());
+        assert!(node.disconnect(&String::from("api"), "evicted").is_err());
+        assert!(node.connections.contains_key("api"));
+    }
+
+    /// Sending close event with given reason from peer and closing its side
+    fn close_from_peer(peer: &mut Peer, reason: &str) {
+        let mut event = Event::default();
+        event.name = String::from(CONNECTION_CLOSE_EVENT);
+        event.from = peer.token.clone();
+        event.data = Vec::from(reason.as_bytes());
+        peer.send(&event);
+        peer.stream.shutdown(Shutdown::Write).unwrap();
+    }
+
+    #[test]
+    fn remote_close_reason_from_close_event() {
+        let mut node = testing::node(&[]);
+        let mut child = Peer::connect(&mut node, "child", 3);
+
+        close_from_peer(&mut child, "maintenance");
+        testing::run_until(&mut node, |n| closed_reason(n, "child").is_some());
+        assert_eq!(closed_reason(&node, "child"), Some(CloseReason::Remote(String::from("maintenance"))));
+    }
+
+    #[test]
+    fn capacity_close_reason_from_close_event() {
+        let mut node = testing::node(&[]);
+        let mut parent = Peer::connect(&mut node, "parent", 3);
+
+        // other side is rejecting this Node because it's full
+        close_from_peer(&mut parent, CONNECTION_CAPACITY_REASON);
+        testing::run_until(&mut node, |n| closed_reason(n, "parent").is_some());
+        assert_eq!(closed_reason(&node, "parent"), Some(CloseReason::Capacity));
+    }
+
+    #[test]
+    fn protocol_close_reason_for_invalid_data() {
+        let mut node = testing::node(&[("close_on_decode_failure", "true")]);
+        let mut child = Peer::connect(&mut node, "child", 3);
+
+        child.stream.write_all(&[0, 0, 0, 3, 1, 2, 3]).unwrap();
+        testing::run_until(&mut node, |n| closed_reason(n, "child").is_some());
+        assert_eq!(closed_reason(&node, "child"), Some(CloseReason::Protocol(String::from("Unable to decode event"))));
+    }
+
+    #[test]
+    fn clean_close_reason() {
+        let mut node = testing::node(&[]);
+        let child = Peer::connect(&mut node, "child", 3);
+
+        drop(child);
+        testing::run_until(&mut node, |n| closed_reason(n, "child").is_some());
+        assert_eq!(closed_reason(&node, "child"), Some(CloseReason::Remote(String::new())));
+    }
+
+    #[test]
+    fn error_close_reason() {
+        let mut node = testing::node(&[]);
+        let child = Peer::connect(&mut node, "child", 3);
+
+        // closing socket with unread data is resetting connection
+        let mut event = Event::default();
+        event.name = String::from("unread");
+        assert!(node.send_event(&String::from("child"), TcpHandlerCMD::WriteData, &event));
+        testing::run_for(&mut node, Duration::from_millis(100));
+        drop(child);
+
+        testing::run_until(&mut node, |n| closed_reason(n, "child").is_some());
+        match closed_reason(&node, "child") {
+            Some(CloseReason::Error(_)) => {}
+            r => panic!("expected connection error, got {:?}", r)
+        }
+    }
+
+    #[test]
+    fn connections_over_limit_rejected() {
+        let mut node = testing::node(&[("max_connections", "2"), ("max_api_connections", "1")]);
+        let _first = Peer::connect(&mut node, "first", 3);
+        let _second = Peer::connect(&mut node, "second", 5);
+        let _api = Peer::connect(&mut node, "api", 0);
+
+        let mut third = Peer::connect_raw(&node, "third", 7);
+        let mut other_api = Peer::connect_raw(&node, "other-api", 0);
+        testing::run_for(&mut node, Duration::from_millis(200));
+        third.read_handshake();
+        other_api.read_handshake();
+        assert_eq!(third.read_close(), Some(String::from(CONNECTION_CAPACITY_REASON)));
+        assert_eq!(other_api.read_close(), Some(String::from(CONNECTION_CAPACITY_REASON)));
+        assert!(third.is_closed() && other_api.is_closed());
+        assert!(!node.connections.contains_key("third") && !node.connections.contains_key("other-api"));
+        assert_eq!(node.connections.len(), 3);
+    }
+
+    #[test]
+    fn parent_and_mirror_not_counted() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let parent_address = format!("{}", listener.local_addr().unwrap());
+        let mut node = testing::node(&[("max_connections", "1"), ("mirror", "standby"), ("parent", parent_address.as_str())]);
+        let _child = Peer::connect(&mut node, "child", 3);
+        let _standby = Peer::connect(&mut node, "standby", 5);
+
+        // parent is accepted even if children limit is reached
+        let _parent = Peer::accept(&listener, &mut node, "parent", 7);
+        assert_eq!(node.parent_token, Some(String::from("parent")));
+
+        let mut extra = Peer::connect_raw(&node, "extra", 11);
+        testing::run_for(&mut node, Duration::from_millis(200));
+        extra.read_handshake();
+        assert_eq!(extra.read_close(), Some(String::from(CONNECTION_CAPACITY_REASON)));
+        assert_eq!(node.connections.len(), 3);
+    }
+
+    /// Losing parent of the Node with given policy, while API connection is connected
+    fn lose_parent(policy: &str) -> (Node, Peer, TcpListener) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let parent_address = format!("{}", listener.local_addr().unwrap());
+        let mut node = testing::node(&[("parent", parent_address.as_str()), ("parent_loss_policy", policy)]);
+        let parent = Peer::accept(&listener, &mut node, "parent", 7);
+        let api = Peer::connect(&mut node, "api", 0);
+
+        parent.stream.shutdown(Shutdown::Both).unwrap();
+        drop(parent);
+        testing::run_until(&mut node, |n| !n.lost_parents.is_empty());
+        (node, api, listener)
+    }
+
+    #[test]
+    fn parent_loss_keeps_api_connections() {
+        let (mut node, mut api, _listener) = lose_parent("keep");
+        testing::run_for(&mut node, Duration::from_millis(100));
+        assert!(node.connections.contains_key("api"));
+
+        // nothing is sent to API connection
+        api.stream.set_read_timeout(Some(Duration::from_millis(100))).unwrap();
+        assert!(api.read_event().is_none());
+    }
+
+    #[test]
+    fn parent_loss_notifies_api_connections() {
+        let (node, mut api, _listener) = lose_parent("notify");
+        assert!(node.connections.contains_key("api"));
+        assert_eq!(api.read_event().map(|e| e.name), Some(String::from(PARENT_LOST_EVENT)));
+    }
+
+    #[test]
+    fn parent_loss_disconnects_api_connections() {
+        let (mut node, mut api, _listener) = lose_parent("disconnect");
+        assert_eq!(api.read_close(), Some(String::from("parent connection lost")));
+
+        api.stream.shutdown(Shutdown::Write).unwrap();
+        testing::run_until(&mut node, |n| !n.connections.contains_key("api"));
+    }
+
+    #[test]
+    fn parent_events_buffered_until_reconnect() {
+        let (mut node, _api, listener) = lose_parent("keep");
+
+        let mut event = Event::default();
+        event.name = String::from("upstream");
+        event.from = node.token.clone();
+        event.path.mul(7);
+        node.emit(event);
+        assert_eq!(node.net_parent_buffer.len(), 1);
+
+        let parent_address = node.parent_address.clone();
+        assert!(node.tcp_connect(parent_address.as_str()));
+        let mut parent = Peer::accept(&listener, &mut node, "parent", 7);
+        parent.read_handshake();
+        testing::run_for(&mut node, Duration::from_millis(100));
+        assert_eq!(parent.read_event().map(|e| e.name), Some(String::from("upstream")));
+        assert!(node.net_parent_buffer.is_empty());
+        assert_eq!(node.net_lost_parent_value, 0);
+    }
+
+    #[test]
+    fn parent_buffer_drops_oldest() {
+        let (mut node, _api, _listener) = lose_parent("keep");
+        for i in 0..PARENT_BUFFER_SIZE + 2 {
+            let mut event = Event::default();
+            event.name = format!("upstream{}", i);
+            event.path.mul(7);
+            node.emit(event);
+        }
+
+        assert_eq!(node.net_parent_buffer.len(), PARENT_BUFFER_SIZE);
+        assert_eq!(node.net_parent_buffer_dropped, 2);
+        assert_eq!(node.net_parent_buffer.front().map(|e| e.name.clone()), Some(String::from("upstream2")));
+    }
+
+    #[test]
+    fn forward_filter_decisions() {
+        let mut node = testing::node(&[]);
+        node.set_forward_filter(Box::new(|event: &Event| match event.name.as_str() {
+            "local" => ForwardDecision::Local,
+            "drop" => ForwardDecision::Drop,
+            _ => ForwardDecision::Forward
+        }));
+        let events = node.subscribe(10);
+        let mut source = Peer::connect(&mut node, "source", 3);
+        let mut target = Peer::connect(&mut node, "target", 5);
+
+        for (i, name) in ["drop", "local", "forward"].iter().enumerate() {
+            let mut event = Event::default();
+            event.name = String::from(*name);
+            event.from = String::from("source");
+            event.id = i as u64 + 1;
+            event.path.mul(5);
+            source.send(&event);
+        }
+
+        // dropped event is not handled, local one is handled without forwarding
+        let mut handled = vec![];
+        testing::run_until(&mut node, |_| {
+            while let Ok(r) = events.try_recv() {
+                handled.push(r.event.name);
+            }
+            handled.len() == 2
+        });
+        assert_eq!(handled, vec![String::from("local"), String::from("forward")]);
+        assert_eq!(target.read_event().map(|e| e.name), Some(String::from("forward")));
+
+        testing::run_for(&mut node, Duration::from_millis(100));
+        target.stream.set_read_timeout(Some(Duration::from_millis(100))).unwrap();
+        assert!(target.read_event().is_none());
+    }
+
+    fn routed_event(name: &str, from: &str, id: u64, path: u64) -> Event {
+        let mut event = Event::default();
+        event.name = String::from(name);
+        event.from = String::from(from);
+        event.id = id;
+        event.path.mul(path);
+        event
+    }
+
+    #[test]
+    fn mirror_gets_received_events_only() {
+        let mut node = testing::node(&[("mirror", "standby")]);
+        let mut source = Peer::connect(&mut node, "source", 3);
+        let mut standby = Peer::connect(&mut node, "standby", 5);
+        let mut target = Peer::connect(&mut node, "target", 7);
+
+        // received event is forwarded by path and mirrored without path
+        source.send(&routed_event("update", "source", 1, 5 * 7));
+        testing::run_until(&mut node, |n| n.mirror_stats().sent == 1);
+        testing::run_for(&mut node, Duration::from_millis(100));
+        assert_eq!(target.read_event().map(|e| e.name), Some(String::from("update")));
+        let mirrored = standby.read_event().unwrap();
+        assert_eq!(mirrored.name, "update");
+        assert!(mirrored.path.is_zero());
+
+        // standby value in path is not routing to it
+        node.emit(routed_event("routed", "node", 0, 5));
+        testing::run_for(&mut node, Duration::from_millis(100));
+        standby.stream.set_read_timeout(Some(Duration::from_millis(100))).unwrap();
+        assert!(standby.read_event().is_none());
+
+        // and it's not getting keys of the children
+        let ring = node.children_ring(16);
+        for i in 0..100 {
+            let owner = ring.get(format!("key{}", i).as_str()).unwrap();
+            assert!(owner == "source" || owner == "target");
+        }
+    }
+
+    #[test]
+    fn mirror_missed_while_standby_not_connected() {
+        let mut node = testing::node(&[("mirror", "standby")]);
+        let mut source = Peer::connect(&mut node, "source", 3);
+
+        source.send(&routed_event("update", "source", 1, 1));
+        source.send(&routed_event("update", "source", 2, 1));
+        testing::run_until(&mut node, |n| n.mirror_stats().missed == 2);
+        assert_eq!(node.mirror_stats().sent, 0);
+        assert_eq!(node.mirror_stats().dropped, 0);
+    }
+
+    #[test]
+    fn mirror_dropped_counted_in_stats() {
+        let mut node = testing::node(&[("mirror", "standby")]);
+        node.net_tcp_handler_config.mirror_dropped.fetch_add(3, Ordering::Relaxed);
+        assert_eq!(node.mirror_stats().dropped, 3);
+    }
+
+    #[test]
+    fn paused_connection_read_after_resume() {
+        let mut node = testing::node(&[]);
+        let events = node.subscribe(10);
+        let mut child = Peer::connect(&mut node, "child", 3);
+        let token = String::from("child");
+
+        assert!(node.pause_reading(&token));
+        testing::run_for(&mut node, Duration::from_millis(100));
+        child.send(&routed_event("first", "child", 1, 1));
+        child.send(&routed_event("second", "child", 2, 1));
+        testing::run_for(&mut node, Duration::from_millis(200));
+        assert!(events.try_recv().is_err());
+
+        // data which came while paused is already in socket
+        // so it should be read without any new data from other side
+        assert!(node.resume_reading(&token));
+        let mut names = vec![];
+        testing::run_until(&mut node, |_| {
+            while let Ok(r) = events.try_recv() {
+                names.push(r.event.name);
+            }
+            names.len() == 2
+        });
+        assert_eq!(names, vec![String::from("first"), String::from("second")]);
+    }
+
+    #[test]
+    fn live_bytes_of_open_connection() {
+        let mut node = testing::node(&[]);
+        let mut child = Peer::connect(&mut node, "child", 3);
+        let (read, written) = node.connections["child"].total_bytes();
+        // handshake of the both sides
+        assert_eq!(read, 21);
+        assert_eq!(written, 20);
+        assert_eq!((node.connections["child"].bytes_read, node.connections["child"].bytes_written), (0, 0));
+
+        child.send(&routed_event("update", "child", 1, 1));
+        testing::run_until(&mut node, |n| n.connections["child"].total_bytes().0 > read);
+    }
+}
@@ -0,0 +1,139 @@
+#![allow(dead_code)]
+extern crate serde_json;
+
+use self::serde_json::Value;
+
+use std::collections::BTreeSet;
+use std::fs::File;
+use std::io::Read;
+
+/// Known in advance topology of the Node connections
+/// Loaded from JSON file in {"parent": "TOKEN", "children": ["TOKEN", ...]} format
+/// Node connections which are not listed here are rejected
+/// API connections are not checked
+pub struct TopologyManifest {
+    // allowed parent token, None if any parent is allowed
+    pub parent: Option<String>,
+
+    // allowed tokens for all other Node connections
+    pub children: BTreeSet<String>
+}
+
+impl TopologyManifest {
+    /// Loading manifest from JSON file
+    pub fn load(path: &str) -> Result<TopologyManifest, String> {
+        let mut content = String::new();
+        match File::open(path) {
+            Ok(mut f) => {
+                if let Err(e) = f.read_to_string(&mut content) {
+                    return Err(format!("Unable to read topology manifest \"{}\" -> {}", path, e));
+                }
+            }
+            Err(e) => return Err(format!("Unable to open topology manifest \"{}\" -> {}", path, e))
+        }
+
+        let json: Value = match serde_json::from_str(content.as_str()) {
+            Ok(v) => v,
+            Err(e) => return Err(format!("Unable to parse topology manifest \"{}\" -> {}", path, e))
+        };
+
+        let fields = match json.as_object() {
+            Some(o) => o,
+            None => return Err(format!("Topology manifest \"{}\" should contain JSON object", path))
+        };
+
+        let mut manifest = TopologyManifest {
+            parent: None,
+            children: BTreeSet::new()
+        };
+
+        for (key, value) in fields {
+            match key.as_str() {
+                "parent" => {
+                    manifest.parent = match value.as_str() {
+                        Some(t) => Some(String::from(t)),
+                        None => return Err(String::from("Topology manifest \"parent\" should be a string"))
+                    };
+                }
+
+                "children" => {
+                    let list = match value.as_array() {
+                        Some(l) => l,
+                        None => return Err(String::from("Topology manifest \"children\" should be an array"))
+                    };
+
+                    for child in list {
+                        match child.as_str() {
+                            Some(t) => {
+                                manifest.children.insert(String::from(t));
+                            }
+                            None => return Err(String::from("Topology manifest \"children\" should contain only strings"))
+                        }
+                    }
+                }
+
+                _ => return Err(format!("Unknown topology manifest field \"{}\"", key))
+            }
+        }
+
+        Ok(manifest)
+    }
+
+    /// Checking if Node connection with given token is allowed
+    /// "is_parent" is true for connection which we made to the parent address
+    #[inline(always)]
+    pub fn allows(&self, token: &String, is_parent: bool) -> bool {
+        if is_parent {
+            return match self.parent {
+                Some(ref p) => p == token,
+                None => true
+            };
+        }
+
+        self.children.contains(token)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::Write;
+    use std::process;
+
+    fn manifest_file(name: &str, content: &str) -> String {
+        let path = ::std::env::temp_dir().join(format!("treescale-manifest-{}-{}.json", name, process::id()));
+        File::create(&path).unwrap().write_all(content.as_bytes()).unwrap();
+        String::from(path.to_str().unwrap())
+    }
+
+    #[test]
+    fn one_child_allowed() {
+        let path = manifest_file("child", r#"{"parent": "root", "children": ["child-1"]}"#);
+        let manifest = TopologyManifest::load(path.as_str()).unwrap();
+        assert!(manifest.allows(&String::from("child-1"), false));
+        assert!(!manifest.allows(&String::from("child-2"), false));
+
+        assert!(manifest.allows(&String::from("root"), true));
+        assert!(!manifest.allows(&String::from("other-root"), true));
+        // parent token is not allowed as a child
+        assert!(!manifest.allows(&String::from("root"), false));
+    }
+
+    #[test]
+    fn any_parent_without_parent_field() {
+        let path = manifest_file("no-parent", r#"{"children": []}"#);
+        let manifest = TopologyManifest::load(path.as_str()).unwrap();
+        assert!(manifest.allows(&String::from("root"), true));
+        assert!(!manifest.allows(&String::from("child-1"), false));
+    }
+
+    #[test]
+    fn invalid_manifest() {
+        for content in &[r#"{"children": "child-1"}"#, r#"{"children": [1]}"#, r#"{"parent": 1}"#
+                         , r#"{"childs": []}"#, "[]", "{"] {
+            let path = manifest_file("invalid", content);
+            assert!(TopologyManifest::load(path.as_str()).is_err(), "{}", content);
+        }
+        assert!(TopologyManifest::load("/nonexistent/manifest.json").is_err());
+    }
+}
@@ -2,11 +2,35 @@
 mod main;
 mod tcp;
 mod conn;
+mod manifest;
 
-pub use self::main::{Networking, NetworkCMD, NetworkCommand};
-pub use self::conn::{Connection, ConnectionIdentity, SocketType};
-pub use self::tcp::{TcpNetwork
-                    , TcpHandlerCommand, TcpHandlerCMD, TcpHandler
-                    , Slab , TcpConnection};
+pub use self::main::{Networking, NetworkCMD, NetworkCommand, ParentLossPolicy, ForwardFilter};
+// needed for making forward filters and reading mirror counters,
+// even if Node itself is not using them
+#[allow(unused_imports)]
+pub use self::main::{ForwardDecision, MirrorStats};
+pub use self::conn::{Connection, ConnectionIdentity, SocketType, CloseReason, ByteCounters};
+pub use self::manifest::TopologyManifest;
+pub use self::tcp::{TcpNetwork, TcpAcceptHook
+                    , TcpHandlerCommand, TcpHandlerCMD, TcpHandler, TcpHandlerConfig
+                    , Slab , TcpConnection, Socks5Proxy, HandshakeGuard};
 
-pub const CONNECTION_COUNT_PRE_ALLOC: usize = 1024;
\ No newline at end of file
+pub const CONNECTION_COUNT_PRE_ALLOC: usize = 1024;
+
+/// Event name for notifying other side about closing connection
+/// Event data contains close reason text
+pub const CONNECTION_CLOSE_EVENT: &'static str = "_close";
+
+/// Close reason sent to connection which is rejected
+/// because of the connections count limit
+pub const CONNECTION_CAPACITY_REASON: &'static str = "capacity";
+
+/// Event name for notifying API connections that parent connection is lost
+pub const PARENT_LOST_EVENT: &'static str = "_parent_lost";
+
+/// Max count of events kept for the parent while it's lost with "keep" policy
+/// oldest events are dropped after this
+pub const PARENT_BUFFER_SIZE: usize = 1024;
+
+/// Close reason sent to Node connection which is not listed in topology manifest
+pub const CONNECTION_MANIFEST_REASON: &'static str = "not in topology manifest";
\ No newline at end of file
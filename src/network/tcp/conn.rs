@@ -4,15 +4,26 @@ extern crate mio;
 use std::sync::Arc;
 use std::collections::VecDeque;
 use std::io::{ErrorKind, Read, Write};
-use std::net::Shutdown;
+use std::net::{Shutdown, SocketAddr};
 use std::error::Error;
+use std::time::{Duration, Instant};
+use std::usize;
 
-use helper::{Log, NetHelper};
+use helper::{Log, NetHelper, RateLimiter};
+use network::{CloseReason, ByteCounters};
 
 use self::mio::{Token, Poll, PollOpt, Ready};
 use self::mio::tcp::TcpStream;
 
+/// Max length of data accepted during handshake
+/// Token and Value are small, so there is no need to read more than this
+/// from not yet accepted connection
+pub const MAX_HANDSHAKE_DATA_LEN: usize = 4096;
+
 /// Base TCP connection structure
+/// Note: read/write deadlines and throttling are kept here only as state
+/// (last_read, last_write, read_limit, write_limit) and TcpHandler is enforcing them from its poll loop,
+/// there are no hooks on the connection itself for custom deadlines or throttling
 pub struct TcpConnection {
     // current API version for this communication channel
     pub api_version: u32,
@@ -21,6 +32,10 @@ pub struct TcpConnection {
     pub socket: TcpStream,
     pub socket_token: Token,
 
+    // generation given by TcpHandler, it's different for each connection
+    // even if they are getting the same socket token one after another
+    pub generation: u64,
+
     // this connection coming from server or client connection
     pub from_server: bool,
 
@@ -44,9 +59,62 @@ pub struct TcpConnection {
     writable: VecDeque<Arc<Vec<u8>>>,
     // index for current partial data to write
     writable_data_index: usize,
+
+    // if this is true, connection would be closed
+    // after flushing all data from write queue
+    pub close_after_write: bool,
+
+    // time after which connection is closed, even if write queue is not flushed yet
+    // so other side which is not reading can't keep it open
+    pub close_deadline: Option<Instant>,
+
+    // time until which connection should finish API handshake
+    // used for limiting the whole client connect time
+    pub handshake_deadline: Option<Instant>,
+
+    // true after shutting down writing part of connection
+    // we are only waiting for other side to close it
+    pub write_closed: bool,
+
+    // if this is true we are not reading from connection
+    // so other side would be blocked by TCP flow control
+    pub paused: bool,
+
+    // reason of closing this connection
+    pub close_reason: CloseReason,
+
+    // remote address which we got during accept or connect
+    pub remote_address: Option<SocketAddr>,
+
+    // total bytes count read from and written to this connection
+    // same counts are shared with Networking for reading them while connection is open
+    pub bytes_read: u64,
+    pub bytes_written: u64,
+    pub traffic: Arc<ByteCounters>,
+
+    // last time when something was read from connection
+    // and when write queue got data or was moving forward
+    // used for read and write timeouts
+    pub last_read: Instant,
+    pub last_write: Instant,
+
+    // bytes per second limits for reading from and writing to this connection
+    pub read_limit: Option<RateLimiter>,
+    pub write_limit: Option<RateLimiter>,
+
+    // time until which reading or writing is stopped
+    // because connection transferred more than its limit allows
+    pub read_throttled: Option<Instant>,
+    pub write_throttled: Option<Instant>,
 }
 
 impl TcpConnection {
+    #[inline(always)]
+    fn count_read(&mut self, bytes: usize) {
+        self.bytes_read += bytes as u64;
+        self.traffic.add_read(bytes);
+    }
+
     /// Making new TCP connection from accepted socket
     #[inline(always)]
     pub fn new(socket: TcpStream, token: Token, from_server: bool) -> TcpConnection {
@@ -54,6 +122,7 @@ impl TcpConnection {
             api_version: 0,
             socket: socket,
             socket_token: token,
+            generation: 0,
             from_server: from_server,
             conn_token: String::default(),
             conn_value: 0,
@@ -63,7 +132,23 @@ impl TcpConnection {
             pending_endian: vec![0; 4],
             pending_endian_index: 0,
             writable: VecDeque::new(),
-            writable_data_index: 0
+            writable_data_index: 0,
+            close_after_write: false,
+            close_deadline: None,
+            handshake_deadline: None,
+            write_closed: false,
+            paused: false,
+            close_reason: CloseReason::Remote(String::new()),
+            remote_address: None,
+            bytes_read: 0,
+            bytes_written: 0,
+            traffic: Arc::new(ByteCounters::new()),
+            last_read: Instant::now(),
+            last_write: Instant::now(),
+            read_limit: None,
+            write_limit: None,
+            read_throttled: None,
+            write_throttled: None
         }
     }
 
@@ -72,6 +157,18 @@ impl TcpConnection {
         self.writable.push_back(data);
     }
 
+    /// Checking if we have data in write queue
+    #[inline(always)]
+    pub fn has_writable_data(&self) -> bool {
+        !self.writable.is_empty()
+    }
+
+    /// Getting count of queued writes
+    #[inline(always)]
+    pub fn writable_len(&self) -> usize {
+        self.writable.len()
+    }
+
     /// Registering connection to give POLL service
     #[inline(always)]
     pub fn register(&self, poll: &Poll) -> bool {
@@ -86,10 +183,19 @@ impl TcpConnection {
         true
     }
 
-    /// Making connection writable for given POLL service
+    /// Checking if we should read from connection
+    /// it's not when reading is paused or throttled by read limit
+    #[inline(always)]
+    pub fn is_reading(&self) -> bool {
+        !self.paused && self.read_throttled.is_none()
+    }
+
+    /// Making connection readable for given POLL service
+    /// If reading is paused or throttled, connection would be registered without readable interest
     #[inline(always)]
     pub fn make_readable(&self, poll: &Poll) -> bool {
-        match poll.reregister(&self.socket, self.socket_token, Ready::readable(), PollOpt::edge()) {
+        let interest = if self.is_reading() { Ready::readable() } else { Ready::empty() };
+        match poll.reregister(&self.socket, self.socket_token, interest, PollOpt::edge()) {
             Ok(_) => {}
             Err(e) => {
                 Log::error("Unable to make tcp connection readable for given poll service", e.description());
@@ -125,10 +231,13 @@ impl TcpConnection {
                     return Some((false, 0))
                 }
 
+                self.close_reason = CloseReason::Error(format!("{}", e));
                 return None;
             }
         };
 
+        self.count_read(read_len);
+
         // if we got data less than we expected
         if read_len + self.pending_endian_index < 4 {
             self.pending_endian_index += read_len;
@@ -139,6 +248,7 @@ impl TcpConnection {
         // if we are unable to parse given BigEndian
         // then something wrong with connection or API, we should close it
         if !parsed {
+            self.close_reason = CloseReason::Protocol(String::from("Unable to parse BigEndian number"));
             return None;
         }
 
@@ -159,12 +269,14 @@ impl TcpConnection {
     }
 
     /// Reading connection Token and Prime Value combination as a second phase of handshake
+    /// Token is length framed, so it could contain any bytes, but it should be valid UTF-8
+    /// and it is validated later by NetHelper::validate_token
     /// Will return (false, Token, N) if there is not enough data to parse
     /// Will return None if there is connection error and we need to close it
     #[inline(always)]
     pub fn read_token_value(&mut self) -> Option<(bool, String, u64)> {
         // reading BigEndian length of token
-        let (done, data) = match self.read_data_once() {
+        let (done, data) = match self.read_data_once(MAX_HANDSHAKE_DATA_LEN) {
             Some((d, b)) => (d, b),
             None => return None
         };
@@ -174,40 +286,55 @@ impl TcpConnection {
             return Some((false, String::default(), 0))
         }
 
+        match self.parse_token_value(&data) {
+            Some((token, value)) => Some((true, token, value)),
+            None => None
+        }
+    }
+
+    /// Parsing Token and Value from handshake chunk
+    /// Will return None and set close reason if chunk is not a valid Token and Value
+    pub fn parse_token_value(&mut self, data: &Vec<u8>) -> Option<(String, u64)> {
         // our data contains Token and Value
         // where Value is last 8 bytes
         // so len() - 8 should be text length
         if data.len() <= 8 {
             // if we got wrong API closing connection
+            self.close_reason = CloseReason::Protocol(String::from("Handshake data is too short for Token and Value"));
             return None;
         }
 
         let text_len = data.len() - 8;
 
         // Converting our token to string
+        // Note: tokens are kept as String all over the Node, so they should be valid UTF-8
+        // even if raw tokens are allowed, which are only allowing control characters
         let token =  match String::from_utf8(Vec::from(&data[..text_len])) {
             Ok(t) => t,
             Err(e) => {
                 Log::error("Unable to convert received Token bytes to string", e.description());
+                self.close_reason = CloseReason::Protocol(format!("Handshake Token is not valid UTF-8 -> {}", e));
                 return None;
             }
         };
 
         // converting Value bytes to u64
         // if not converted just closing connection, because it is wrong or corrupted API data
-        let (converted, value) = NetHelper::bytes_to_u64(&data, text_len);
+        let (converted, value) = NetHelper::bytes_to_u64(data, text_len);
         if !converted {
+            self.close_reason = CloseReason::Protocol(String::from("Unable to parse handshake Value"));
             return None;
         }
 
-        Some((true, token, value))
+        Some((token, value))
     }
 
     /// Reading only one part of data which means that only one
     /// Byte chunk would be returned
     /// This is the base function to read data from socket
+    /// If data length is bigger than "max_len" it will return None to close connection
     #[inline(always)]
-    pub fn read_data_once(&mut self) -> Option<(bool, Vec<u8>)> {
+    pub fn read_data_once(&mut self, max_len: usize) -> Option<(bool, Vec<u8>)> {
         // fist of all getting BigEndian number to determine how many bytes we need to read
         if self.pending_data_len == 0 {
             let (done_endian, data_len) = match self.read_endian() {
@@ -220,6 +347,20 @@ impl TcpConnection {
                 return Some((false, vec![]));
             }
 
+            // not allocating anything for data which is bigger than allowed
+            if data_len as usize > max_len {
+                Log::warn("Got data bigger than allowed, closing connection"
+                          , format!("{} > {} bytes", data_len, max_len).as_str());
+                self.close_reason = CloseReason::Protocol(format!("Got data bigger than allowed {} > {} bytes", data_len, max_len));
+                return None;
+            }
+
+            // empty chunk is complete right away, reading into empty buffer
+            // would give 0 bytes which is the same as closed connection
+            if data_len == 0 {
+                return Some((true, vec![]));
+            }
+
             // making data with specific length
             self.pending_data_len = data_len as usize;
             self.pending_data.push(vec![0; self.pending_data_len]);
@@ -236,10 +377,13 @@ impl TcpConnection {
                     return Some((false, vec![]))
                 }
 
+                self.close_reason = CloseReason::Error(format!("{}", e));
                 return None;
             }
         };
 
+        self.count_read(read_len);
+
         if self.pending_data_index + read_len < self.pending_data_len {
             self.pending_data_index += read_len;
             return Some((false, vec![]))
@@ -254,14 +398,22 @@ impl TcpConnection {
 
     /// Reading all data available in socket
     /// so this will return only if read_once function will send (false, vec![])
+    /// or if "max_bytes" is already read, then rest of the data is kept in socket
     /// This will help to get all data once and then consume it using single event
+    /// Returns read data and true if there is connection error and we need to close it,
+    /// data read before error is returned anyway, because it could end with close event
     #[inline(always)]
-    pub fn read_data(&mut self) -> Option<Vec<Vec<u8>>> {
+    pub fn read_data(&mut self, max_bytes: usize) -> (Vec<Vec<u8>>, bool) {
         let mut total: Vec<Vec<u8>> = vec![];
+        let started = self.bytes_read;
         loop {
-            let (done, data) = match self.read_data_once() {
+            if (self.bytes_read - started) as usize >= max_bytes {
+                break
+            }
+
+            let (done, data) = match self.read_data_once(usize::MAX) {
                 Some(d) => d,
-                None => return None
+                None => return (total, true)
             };
 
             // if we need more data then just breaking the loop
@@ -274,7 +426,7 @@ impl TcpConnection {
             total.push(data);
         }
 
-        Some(total)
+        (total, false)
     }
 
     /// Shutting down connection, this would be called before closing connection
@@ -286,6 +438,49 @@ impl TcpConnection {
         }
     }
 
+    /// Reading and ignoring all data available in socket
+    /// used after shutting down writing part, to find out when other side closes connection
+    /// Returns false if other side closed connection or there is a connection error
+    pub fn drain(&mut self) -> bool {
+        let mut buffer = [0u8; 4096];
+        loop {
+            match self.socket.read(&mut buffer) {
+                Ok(0) => return false,
+                Ok(n) => self.count_read(n),
+                Err(e) => return e.kind() == ErrorKind::WouldBlock
+            }
+        }
+    }
+
+    /// Shutting down only writing part of connection
+    /// so other side would get EOF after reading all data that we sent
+    #[inline(always)]
+    pub fn close_write(&self) {
+        match self.socket.shutdown(Shutdown::Write) {
+            Ok(_) => {},
+            Err(e) => Log::error("Error while trying to shutdown connection write", e.description())
+        }
+    }
+
+    /// Setting SO_LINGER for this connection
+    /// None is keeping system default behaviour
+    #[inline(always)]
+    pub fn set_linger(&self, duration: Option<Duration>) -> bool {
+        if duration.is_none() {
+            return true;
+        }
+
+        match self.socket.set_linger(duration) {
+            Ok(_) => {}
+            Err(e) => {
+                Log::error("Unable to set linger for tcp connection", e.description());
+                return false;
+            }
+        }
+
+        true
+    }
+
     /// Main function to write to TCP connection
     /// It will add data to "writable" as a write queue
     #[inline(always)]
@@ -295,10 +490,12 @@ impl TcpConnection {
     }
 
     /// Tying to flush all data what we have right now in our socket
+    /// but not more than "max_bytes"
     /// Returns None if there is a connection error
     /// Returns Some(true) if queue is now empty
     /// Returns Some(false) if we still have something in queue
-    pub fn flush(&mut self) -> Option<bool> {
+    pub fn flush(&mut self, max_bytes: usize) -> Option<bool> {
+        let mut left = max_bytes;
         loop {
             {
                 let data = match self.writable.front() {
@@ -306,7 +503,12 @@ impl TcpConnection {
                     None => break // there is no data in queue
                 };
 
-                let write_len = match self.socket.write(&data[self.writable_data_index..]) {
+                if left == 0 {
+                    return Some(false);
+                }
+
+                let end = if data.len() - self.writable_data_index > left { self.writable_data_index + left } else { data.len() };
+                let write_len = match self.socket.write(&data[self.writable_data_index..end]) {
                     Ok(n) => n,
                     Err(e) => {
                         // if we got WouldBlock, then this is Non Blocking socket
@@ -315,10 +517,15 @@ impl TcpConnection {
                             return Some(false)
                         }
 
+                        self.close_reason = CloseReason::Error(format!("{}", e));
                         return None;
                     }
                 };
 
+                self.bytes_written += write_len as u64;
+                self.traffic.add_written(write_len);
+                left -= write_len;
+
                 // if socket is unable to write all data that we have
                 // then moving forward index and waiting until next time
                 if write_len + self.writable_data_index < data.len() {
@@ -337,4 +544,119 @@ impl TcpConnection {
 
         Some(true)
     }
-}
\ No newline at end of file
+}
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::{TcpListener, TcpStream as StdTcpStream};
+    use std::thread;
+
+    /// Making connection with other side of it as a blocking socket
+    fn socket_pair() -> (TcpConnection, StdTcpStream) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let socket = TcpStream::connect(&listener.local_addr().unwrap()).unwrap();
+        let (peer, _) = listener.accept().unwrap();
+        (TcpConnection::new(socket, Token(0), true), peer)
+    }
+
+    /// Reading Token and Value until data arrives to non blocking socket
+    fn token_value(conn: &mut TcpConnection) -> Option<(String, u64)> {
+        for _ in 0..1000 {
+            match conn.read_token_value() {
+                Some((true, token, value)) => return Some((token, value)),
+                Some((false, _, _)) => thread::yield_now(),
+                None => return None
+            }
+        }
+        panic!("handshake data didn't arrive");
+    }
+
+    fn frame(data: &[u8]) -> Vec<u8> {
+        let mut framed = vec![0; 4];
+        NetHelper::u32_to_bytes(data.len() as u32, &mut framed, 0);
+        framed.extend_from_slice(data);
+        framed
+    }
+
+    #[test]
+    fn token_value_parsed() {
+        let (mut conn, mut peer) = socket_pair();
+        peer.write_all(frame(&[b'p', b'e', b'e', b'r', 0, 0, 0, 0, 0, 0, 0, 7]).as_slice()).unwrap();
+        assert_eq!(token_value(&mut conn), Some((String::from("peer"), 7)));
+    }
+
+    #[test]
+    fn oversized_handshake_rejected_before_reading() {
+        let (mut conn, mut peer) = socket_pair();
+        // only length is sent, so data is never allocated or read
+        let mut length = vec![0; 4];
+        NetHelper::u32_to_bytes((MAX_HANDSHAKE_DATA_LEN + 1) as u32, &mut length, 0);
+        peer.write_all(length.as_slice()).unwrap();
+
+        assert_eq!(token_value(&mut conn), None);
+        assert!(conn.pending_data.is_empty());
+        match conn.close_reason {
+            CloseReason::Protocol(ref r) => assert!(r.starts_with("Got data bigger than allowed")),
+            _ => panic!("expected protocol close reason")
+        }
+    }
+
+    #[test]
+    fn short_handshake_rejected() {
+        let (mut conn, mut peer) = socket_pair();
+        peer.write_all(frame(&[0, 0, 0, 0, 0, 0, 0, 7]).as_slice()).unwrap();
+        assert_eq!(token_value(&mut conn), None);
+        assert_eq!(conn.close_reason, CloseReason::Protocol(String::from("Handshake data is too short for Token and Value")));
+    }
+
+    #[test]
+    fn big_frames_pass_after_handshake() {
+        let (mut conn, mut peer) = socket_pair();
+        let big = vec![5; MAX_HANDSHAKE_DATA_LEN * 4];
+        let mut data = frame(&[b'p', 0, 0, 0, 0, 0, 0, 0, 7]);
+        data.extend(frame(big.as_slice()));
+        data.extend(frame(&[1, 2, 3]));
+        peer.write_all(data.as_slice()).unwrap();
+
+        assert_eq!(token_value(&mut conn), Some((String::from("p"), 7)));
+        let mut frames = vec![];
+        for _ in 0..1000 {
+            let (data, closed) = conn.read_data(usize::MAX);
+            assert!(!closed);
+            frames.extend(data);
+            if frames.len() == 2 {
+                break;
+            }
+            thread::yield_now();
+        }
+        assert!(frames == vec![big, vec![1, 2, 3]]);
+    }
+
+    #[test]
+    fn byte_counters_shared() {
+        let (mut conn, mut peer) = socket_pair();
+        let traffic = conn.traffic.clone();
+        peer.write_all(frame(&[b'p', 0, 0, 0, 0, 0, 0, 0, 7]).as_slice()).unwrap();
+        assert_eq!(token_value(&mut conn), Some((String::from("p"), 7)));
+        assert_eq!(conn.bytes_read, 13);
+        assert_eq!(traffic.get(), (13, 0));
+
+        conn.add_writable_data(Arc::new(vec![1, 2, 3]));
+        assert_eq!(conn.flush(usize::MAX), Some(true));
+        assert_eq!(conn.bytes_written, 3);
+        assert_eq!(traffic.get(), (13, 3));
+    }
+
+    #[test]
+    fn non_utf8_token_rejected() {
+        let (mut conn, _peer) = socket_pair();
+        assert_eq!(conn.parse_token_value(&vec![0xff, 0xfe, 0, 0, 0, 0, 0, 0, 0, 7]), None);
+        match conn.close_reason {
+            CloseReason::Protocol(ref r) => assert!(r.starts_with("Handshake Token is not valid UTF-8")),
+            _ => panic!("expected protocol close reason")
+        }
+
+        // control characters are parsed, raw tokens policy is checked after that
+        assert_eq!(conn.parse_token_value(&vec![b'p', 0, 1, 0, 0, 0, 0, 0, 0, 0, 7]), Some((String::from("p\0\u{1}"), 7)));
+    }
+}
@@ -0,0 +1,187 @@
+#![allow(dead_code)]
+
+use helper::{Clock, SystemClock};
+
+use std::collections::BTreeMap;
+use std::net::IpAddr;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+/// Counting failed handshakes for each remote IP
+/// If IP have more than "max_failures" failed handshakes during "window"
+/// all connections from that IP are rejected for "cooldown" time
+pub struct HandshakeGuard {
+    // failed handshakes count and time of the first failure in current window
+    failures: BTreeMap<IpAddr, (usize, Instant)>,
+
+    // blocked IPs with block start time
+    blocked: BTreeMap<IpAddr, Instant>,
+
+    // 0 is disabling this guard
+    max_failures: usize,
+    window: Duration,
+    cooldown: Duration,
+    clock: Arc<Clock>
+}
+
+impl HandshakeGuard {
+    pub fn new(max_failures: usize, window: Duration, cooldown: Duration) -> HandshakeGuard {
+        HandshakeGuard::with_clock(max_failures, window, cooldown, Arc::new(SystemClock))
+    }
+
+    /// Making guard which is using given clock for windows and cooldowns
+    pub fn with_clock(max_failures: usize, window: Duration, cooldown: Duration, clock: Arc<Clock>) -> HandshakeGuard {
+        HandshakeGuard {
+            failures: BTreeMap::new(),
+            blocked: BTreeMap::new(),
+            max_failures: max_failures,
+            window: window,
+            cooldown: cooldown,
+            clock: clock
+        }
+    }
+
+    /// Checking if we can accept connection from given IP
+    pub fn allowed(&mut self, ip: &IpAddr) -> bool {
+        if self.max_failures == 0 {
+            return true;
+        }
+
+        let now = self.clock.now();
+        let expired = match self.blocked.get(ip) {
+            Some(t) => now.duration_since(*t) > self.cooldown,
+            None => return true
+        };
+
+        if expired {
+            self.blocked.remove(ip);
+        }
+
+        expired
+    }
+
+    /// Adding failed handshake for given IP
+    /// Returns true if IP became blocked because of this failure
+    pub fn failed(&mut self, ip: IpAddr) -> bool {
+        if self.max_failures == 0 {
+            return false;
+        }
+
+        // removing old entries on each failure, so rotating IPs
+        // wouldn't keep memory growing
+        let now = self.clock.now();
+        self.expire(now);
+
+        let count = {
+            let entry = self.failures.entry(ip).or_insert((0, now));
+            entry.0 += 1;
+            entry.0
+        };
+
+        if count < self.max_failures {
+            return false;
+        }
+
+        self.failures.remove(&ip);
+        self.blocked.insert(ip, now);
+        true
+    }
+
+    /// Removing failure windows and blocks which are already passed
+    fn expire(&mut self, now: Instant) {
+        let old_failures: Vec<IpAddr> = self.failures.iter()
+            .filter(|&(_, &(_, t))| now.duration_since(t) > self.window)
+            .map(|(ip, _)| *ip)
+            .collect();
+        for ip in old_failures {
+            self.failures.remove(&ip);
+        }
+
+        let old_blocks: Vec<IpAddr> = self.blocked.iter()
+            .filter(|&(_, t)| now.duration_since(*t) > self.cooldown)
+            .map(|(ip, _)| *ip)
+            .collect();
+        for ip in old_blocks {
+            self.blocked.remove(&ip);
+        }
+    }
+
+    #[inline(always)]
+    pub fn blocked_count(&self) -> usize {
+        self.blocked.len()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use helper::FakeClock;
+
+    fn ip(last: u8) -> IpAddr {
+        IpAddr::from([10, 0, 0, last])
+    }
+
+    #[test]
+    fn blocked_after_threshold() {
+        let mut guard = HandshakeGuard::new(3, Duration::from_secs(60), Duration::from_secs(300));
+        assert!(!guard.failed(ip(1)));
+        assert!(!guard.failed(ip(1)));
+        assert!(guard.allowed(&ip(1)));
+        assert!(guard.failed(ip(1)));
+
+        // blocked IP is refused during cooldown, others are fine
+        assert!(!guard.allowed(&ip(1)));
+        assert!(!guard.allowed(&ip(1)));
+        assert!(guard.allowed(&ip(2)));
+        assert_eq!(guard.blocked_count(), 1);
+    }
+
+    #[test]
+    fn allowed_after_cooldown() {
+        let clock = Arc::new(FakeClock::new());
+        let mut guard = HandshakeGuard::with_clock(1, Duration::from_secs(60), Duration::from_secs(300), clock.clone());
+        assert!(guard.failed(ip(1)));
+        assert!(!guard.allowed(&ip(1)));
+
+        clock.advance(Duration::from_secs(300));
+        assert!(!guard.allowed(&ip(1)));
+
+        clock.advance(Duration::from_secs(1));
+        assert!(guard.allowed(&ip(1)));
+        assert_eq!(guard.blocked_count(), 0);
+    }
+
+    #[test]
+    fn failures_outside_window() {
+        let clock = Arc::new(FakeClock::new());
+        let mut guard = HandshakeGuard::with_clock(2, Duration::from_secs(60), Duration::from_secs(300), clock.clone());
+        assert!(!guard.failed(ip(1)));
+        clock.advance(Duration::from_secs(61));
+        // first failure expired, so this is the first one again
+        assert!(!guard.failed(ip(1)));
+        assert!(guard.allowed(&ip(1)));
+    }
+
+    #[test]
+    fn rotating_ips_are_cleaned() {
+        let clock = Arc::new(FakeClock::new());
+        let mut guard = HandshakeGuard::with_clock(2, Duration::from_secs(60), Duration::from_secs(60), clock.clone());
+        for i in 0..100 {
+            guard.failed(ip(i));
+        }
+        assert_eq!(guard.failures.len(), 100);
+
+        clock.advance(Duration::from_secs(61));
+        guard.failed(ip(200));
+        assert_eq!(guard.failures.len(), 1);
+    }
+
+    #[test]
+    fn disabled_guard() {
+        let mut guard = HandshakeGuard::new(0, Duration::from_secs(60), Duration::from_secs(300));
+        for _ in 0..10 {
+            assert!(!guard.failed(ip(1)));
+        }
+        assert!(guard.allowed(&ip(1)));
+    }
+}
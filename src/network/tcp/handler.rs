@@ -4,26 +4,43 @@ extern crate mio;
 use std::process;
 use std::error::Error;
 use std::sync::Arc;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::{Duration, Instant};
 
-use network::tcp::TcpConnection;
-use network::{NetworkCommand, NetworkCMD, Slab, CONNECTION_COUNT_PRE_ALLOC, ConnectionIdentity, SocketType, Connection};
+use network::tcp::{TcpConnection, MAX_HANDSHAKE_DATA_LEN};
+use network::{NetworkCommand, NetworkCMD, Slab, CONNECTION_COUNT_PRE_ALLOC, ConnectionIdentity, SocketType, Connection, CloseReason};
 use node::{NET_RECEIVER_CHANNEL_TOKEN, EVENT_LOOP_EVENTS_SIZE};
-use event::Event;
-use helper::{Log, NetHelper};
+use event::EventCodec;
+use helper::{Log, NetHelper, Clock, RateLimiter};
 
 use self::mio::channel::{Sender, Receiver, channel};
 use self::mio::{Poll, Ready, PollOpt, Token, Events};
 
+/// Max count of queued writes for mirror standby connection
+/// after this mirrored events are dropped until standby reads queued ones
+pub const MIRROR_QUEUE_LIMIT: usize = 1024;
+
+#[derive(Clone, Copy)]
 pub enum TcpHandlerCMD {
     None,
     HandleConnection,
-    WriteData
+    WriteData,
+    // same as WriteData, but dropping data if write queue is longer than MIRROR_QUEUE_LIMIT
+    MirrorData,
+    CloseConnection,
+    PauseReading,
+    ResumeReading,
+    // limiting bytes per second of connection, data contains
+    // read and write rates as BigEndian u64 numbers, 0 is unlimited
+    SetRateLimit
 }
 
 pub struct TcpHandlerCommand {
     pub cmd: TcpHandlerCMD,
     pub conn: Vec<TcpConnection>,
     pub token: Vec<Token>,
+    // generations of connections for each token
+    pub generation: Vec<u64>,
     pub data: Vec<Arc<Vec<u8>>>
 
 }
@@ -34,9 +51,68 @@ impl TcpHandlerCommand {
             cmd: TcpHandlerCMD::None,
             conn: vec![],
             data: vec![],
-            token: vec![]
+            token: vec![],
+            generation: vec![]
         }
     }
+
+    /// Adding channel of the connection which this command is for
+    #[inline(always)]
+    pub fn add_identity(&mut self, identity: &ConnectionIdentity) {
+        self.token.push(identity.socket_token);
+        self.generation.push(identity.generation);
+    }
+}
+
+/// Configuration for connections handled by TcpHandler
+#[derive(Clone)]
+pub struct TcpHandlerConfig {
+    // API version of this Node, connections with other versions are closed
+    pub api_version: u32,
+
+    // accepting connection tokens with control characters
+    // tokens should be valid UTF-8 anyway
+    pub allow_raw_tokens: bool,
+
+    // removing trailing whitespaces and zero bytes from tokens before validation
+    pub trim_tokens: bool,
+
+    // SO_LINGER for Node and API connections
+    // None is keeping system default behaviour
+    pub linger: Option<Duration>,
+    pub api_linger: Option<Duration>,
+
+    // how long to wait for flushing data of the closing connection
+    pub close_timeout: Duration,
+
+    // closing connection if nothing was read from it, or queued data was not written to it
+    // during this time, None is disabling each of them
+    pub read_timeout: Option<Duration>,
+    pub write_timeout: Option<Duration>,
+
+    // bytes per second limits for Node and API connections reading and writing
+    // they could be changed for each connection later, None is unlimited
+    pub read_rate: Option<u64>,
+    pub write_rate: Option<u64>,
+    pub api_read_rate: Option<u64>,
+    pub api_write_rate: Option<u64>,
+
+    // codec for decoding received events
+    pub codec: Arc<EventCodec>,
+
+    // closing connection if received data can't be decoded as event
+    // otherwise just skipping that data
+    pub close_on_decode_failure: bool,
+
+    // count of received data chunks which couldn't be decoded
+    // shared between all handlers
+    pub decode_failures: Arc<AtomicUsize>,
+
+    // count of mirrored events dropped because standby write queue was full
+    pub mirror_dropped: Arc<AtomicUsize>,
+
+    // time source for close deadlines
+    pub clock: Arc<Clock>
 }
 
 /// Main struct for handling TCP connections separately for reading and writing
@@ -56,11 +132,25 @@ pub struct TcpHandler {
 
     // keeping index for this handler for later identification
     index: usize,
+
+    // configuration for handled connections
+    config: TcpHandlerConfig,
+
+    // count of close and handshake deadlines of connections
+    // for not checking deadlines when there is nothing to close
+    deadline_count: usize,
+
+    // count of connections with throttled reading or writing
+    throttled_count: usize,
+
+    // last generation given to handled connection
+    // commands with other generation are for closed connection which had the same slot
+    generation: u64,
 }
 
 impl TcpHandler {
     /// Making new TCP handler service
-    pub fn new(net_chan: Sender<NetworkCommand>, index: usize) -> TcpHandler {
+    pub fn new(net_chan: Sender<NetworkCommand>, index: usize, config: TcpHandlerConfig) -> TcpHandler {
 
         let (s, r) = channel::<TcpHandlerCommand>();
 
@@ -76,7 +166,11 @@ impl TcpHandler {
                     process::exit(1);
                 }
             },
-            index: index
+            index: index,
+            config: config,
+            deadline_count: 0,
+            throttled_count: 0,
+            generation: 0
         }
     }
 
@@ -98,7 +192,17 @@ impl TcpHandler {
         // making events for handling 5K events at once
         let mut events: Events = Events::with_capacity(EVENT_LOOP_EVENTS_SIZE);
         loop {
-            let event_count = self.poll.poll(&mut events, None).unwrap();
+            // waking up for closing connections which are not done in time
+            // or which are not reading or writing during configured timeouts
+            let timeout = self.deadline_wait();
+            let event_count = self.poll.poll(&mut events, timeout).unwrap();
+            if self.deadline_count > 0 || self.has_timeouts() {
+                self.close_expired();
+            }
+            if self.throttled_count > 0 {
+                self.resume_throttled();
+            }
+
             if event_count == 0 {
                 continue;
             }
@@ -129,13 +233,26 @@ impl TcpHandler {
                     // if we got some error on one of the connections
                     // we need to close them
                     if kind.is_error() || kind.is_hup() {
+                        // hup without error is a clean close from other side
+                        if kind.is_error() {
+                            let ref mut conn = self.connections[token];
+                            conn.close_reason = CloseReason::Error(match conn.socket.take_error() {
+                                Ok(Some(e)) => format!("{}", e),
+                                _ => String::from("Socket error")
+                            });
+                        }
+
                         self.close_connection(token);
                         continue;
                     }
 
                     // we only looking for readable connections
                     if kind.is_readable() {
-                        self.readable(token);
+                        // we could still get readable event which was
+                        // queued before pausing or throttling connection
+                        if self.connections[token].is_reading() {
+                            self.readable(token);
+                        }
                         continue;
                     }
 
@@ -148,8 +265,25 @@ impl TcpHandler {
         }
     }
 
+    /// Checking if connection with given token is still the one which command was made for
+    /// slot of the closed connection could be already taken by a new one
+    #[inline(always)]
+    fn is_current(&self, token: Token, generation: u64) -> bool {
+        match self.connections.get(token) {
+            Some(conn) => conn.generation == generation,
+            None => false
+        }
+    }
+
     #[inline(always)]
     fn notify(&mut self, command: &mut TcpHandlerCommand) {
+        // each token should come with generation of its connection
+        if command.token.len() != command.generation.len() {
+            Log::warn("Got TcpHandlerCommand without connection generations, ignoring it"
+                      , format!("{} tokens, {} generations", command.token.len(), command.generation.len()).as_str());
+            return;
+        }
+
         match command.cmd {
             TcpHandlerCMD::HandleConnection => {
                 while !command.conn.is_empty() {
@@ -171,6 +305,13 @@ impl TcpHandler {
 
                     // adding connection to our connections list
                     conn.socket_token = entry.index();
+                    self.generation += 1;
+                    conn.generation = self.generation;
+                    conn.last_read = self.config.clock.now();
+                    conn.last_write = conn.last_read;
+                    if conn.handshake_deadline.is_some() {
+                        self.deadline_count += 1;
+                    }
 
                     // registering and making connection writable first
                     // just to clear write queue from the beginning
@@ -195,11 +336,16 @@ impl TcpHandler {
                 // picking up all connection that we are requested for
                 while !command.token.is_empty() {
                     let token = command.token.remove(0);
-                    if !self.connections.contains(token) {
+                    let generation = command.generation.remove(0);
+                    if !self.is_current(token, generation) {
                         continue;
                     }
 
                     let ref mut conn = self.connections[token];
+                    // write stall is counted from the moment when queue is getting data
+                    if !conn.has_writable_data() {
+                        conn.last_write = self.config.clock.now();
+                    }
 
                     // writing data to connection
                     // this will automatically make connection writable for poll service
@@ -208,15 +354,191 @@ impl TcpHandler {
                     }
                 }
             }
+
+            TcpHandlerCMD::MirrorData => {
+                while !command.token.is_empty() {
+                    let token = command.token.remove(0);
+                    let generation = command.generation.remove(0);
+                    if !self.is_current(token, generation) {
+                        continue;
+                    }
+
+                    let ref mut conn = self.connections[token];
+
+                    // slow standby is missing events
+                    // instead of growing write queue without limit
+                    if conn.writable_len() >= MIRROR_QUEUE_LIMIT {
+                        self.config.mirror_dropped.fetch_add(command.data.len(), Ordering::Relaxed);
+                        continue;
+                    }
+                    if !conn.has_writable_data() {
+                        conn.last_write = self.config.clock.now();
+                    }
+
+                    for data in &command.data {
+                        conn.write(data.clone(), &self.poll);
+                    }
+                }
+            }
+
+            TcpHandlerCMD::CloseConnection => {
+                while !command.token.is_empty() {
+                    let token = command.token.remove(0);
+                    let generation = command.generation.remove(0);
+                    if !self.is_current(token, generation) {
+                        continue;
+                    }
+
+                    let ref mut conn = self.connections[token];
+
+                    // writing close notification data if we have it
+                    // connection would be closed after write queue is flushed
+                    // or after close timeout if other side is not reading
+                    conn.close_after_write = true;
+                    if conn.close_deadline.is_none() {
+                        conn.close_deadline = Some(self.config.clock.now() + self.config.close_timeout);
+                        self.deadline_count += 1;
+                    }
+                    for data in &command.data {
+                        conn.add_writable_data(data.clone());
+                    }
+
+                    conn.make_writable(&self.poll);
+                }
+            }
+
+            TcpHandlerCMD::PauseReading => {
+                while !command.token.is_empty() {
+                    let token = command.token.remove(0);
+                    let generation = command.generation.remove(0);
+                    if !self.is_current(token, generation) {
+                        continue;
+                    }
+
+                    let ref mut conn = self.connections[token];
+                    conn.paused = true;
+                    // if we are writing, connection would be registered
+                    // without readable interest after write queue is flushed
+                    if !conn.has_writable_data() {
+                        conn.make_readable(&self.poll);
+                    }
+                }
+            }
+
+            TcpHandlerCMD::ResumeReading => {
+                while !command.token.is_empty() {
+                    let token = command.token.remove(0);
+                    let generation = command.generation.remove(0);
+                    if !self.is_current(token, generation) {
+                        continue;
+                    }
+
+                    let ref mut conn = self.connections[token];
+                    conn.paused = false;
+                    // registering again would notify us
+                    // about data which is already available in socket
+                    if !conn.has_writable_data() {
+                        conn.make_readable(&self.poll);
+                    }
+                }
+            }
+
+            TcpHandlerCMD::SetRateLimit => {
+                let (read_rate, write_rate) = match command.data.first() {
+                    Some(data) => (NetHelper::bytes_to_u64(data, 0), NetHelper::bytes_to_u64(data, 8)),
+                    None => return
+                };
+                if !read_rate.0 || !write_rate.0 {
+                    Log::warn("Got invalid rate limits with TcpHandlerCommand", "Expecting 2 BigEndian u64 numbers");
+                    return;
+                }
+
+                while !command.token.is_empty() {
+                    let token = command.token.remove(0);
+                    let generation = command.generation.remove(0);
+                    if !self.is_current(token, generation) {
+                        continue;
+                    }
+
+                    let rate = |r: u64| if r == 0 { None } else { Some(r) };
+                    self.set_rate_limit(token, rate(read_rate.1), rate(write_rate.1));
+                }
+            }
+
             TcpHandlerCMD::None => {}
         }
     }
 
+    /// Setting bytes per second limits for connection, None is unlimited
+    fn set_rate_limit(&mut self, token: Token, read_rate: Option<u64>, write_rate: Option<u64>) {
+        let now = self.config.clock.now();
+        let ref mut conn = self.connections[token];
+        conn.read_limit = read_rate.map(|r| RateLimiter::new(r, now));
+        conn.write_limit = write_rate.map(|r| RateLimiter::new(r, now));
+    }
+
+    /// Continuing to read from and write to connections which waited enough for their rate limits
+    fn resume_throttled(&mut self) {
+        let now = self.config.clock.now();
+        let reads: Vec<Token> = self.connections.iter()
+            .filter(|conn| conn.read_throttled.map_or(false, |t| t <= now))
+            .map(|conn| conn.socket_token)
+            .collect();
+        let writes: Vec<Token> = self.connections.iter()
+            .filter(|conn| conn.write_throttled.map_or(false, |t| t <= now))
+            .map(|conn| conn.socket_token)
+            .collect();
+
+        for token in reads {
+            if !self.connections.contains(token) {
+                continue;
+            }
+
+            let reading = {
+                let ref mut conn = self.connections[token];
+                conn.read_throttled = None;
+                self.throttled_count -= 1;
+                if !conn.has_writable_data() {
+                    conn.make_readable(&self.poll);
+                }
+                conn.is_reading()
+            };
+
+            // data could be already waiting in socket
+            // and with edge triggered poll there wouldn't be new event for it
+            if reading {
+                self.readable(token);
+            }
+        }
+
+        for token in writes {
+            if !self.connections.contains(token) {
+                continue;
+            }
+
+            self.connections[token].write_throttled = None;
+            self.throttled_count -= 1;
+            self.writable(token);
+        }
+    }
+
     #[inline(always)]
     fn readable(&mut self, token: Token) {
+        // with edge triggered poll readable event means that other side sent something
+        self.connections[token].last_read = self.config.clock.now();
+
+        // we already sent everything to closing connection
+        // so just waiting until other side closes it too
+        if self.connections[token].write_closed {
+            if !self.connections[token].drain() {
+                self.close_connection(token);
+            }
+            return;
+        }
+
         let accepted = {
             let ref conn: TcpConnection = self.connections[token];
-            Connection::check_api_version(conn.api_version) && conn.conn_token.len() > 0
+            Connection::check_api_version(conn.api_version, self.config.api_version) && conn.conn_token.len() > 0
         };
 
         if !accepted {
@@ -233,61 +555,157 @@ impl TcpHandler {
                 conn.make_writable(&self.poll);
             }
 
+            // now we know if this is an API connection or not
+            // so setting linger and rate limits based on that
+            conn.set_linger(if conn.conn_value == 0 { self.config.api_linger } else { self.config.linger });
+            let (read_rate, write_rate) = if conn.conn_value == 0 {
+                (self.config.api_read_rate, self.config.api_write_rate)
+            } else {
+                (self.config.read_rate, self.config.write_rate)
+            };
+
+            self.set_rate_limit(token, read_rate, write_rate);
             self.accept_connection(token);
-            return
+            if self.connections[token].handshake_deadline.take().is_some() {
+                self.deadline_count -= 1;
+            }
+
+            // other side could send events right after handshake
+            // and they could be already in socket buffer, since poll is edge triggered
+            // we wouldn't get readable event for them, so reading them right away
         }
 
+        let now = self.config.clock.now();
         let (close_conn, data_list, conn_token) = {
             let ref mut conn = self.connections[token];
-            match conn.read_data() {
-                Some(d) => (false, d, conn.conn_token.clone()),
-                None => {
-                    // if we got None then there is something wrong with this connection
-                    // we need to close it
-                    (true, vec![], String::new())
+            let max_bytes = match conn.read_limit {
+                Some(ref mut limit) => limit.available(now),
+                None => usize::MAX
+            };
+            let started = conn.bytes_read;
+            // if there is something wrong with this connection we need to close it
+            // but other side could send close event right before closing, so handling data first
+            let (data_list, close_conn) = conn.read_data(max_bytes);
+
+            // stopping to read until limit allows it again
+            // rest of the data is waiting in socket, so other side is blocked by TCP flow control
+            let read = (conn.bytes_read - started) as usize;
+            if let Some(wait) = conn.read_limit.as_mut().and_then(|limit| limit.take(read, now)) {
+                if !close_conn {
+                    conn.read_throttled = Some(now + wait);
+                    self.throttled_count += 1;
+                    if !conn.has_writable_data() {
+                        conn.make_readable(&self.poll);
+                    }
                 }
             }
-        };
 
-        if close_conn {
-            self.close_connection(token);
-            return;
-        }
+            (close_conn, data_list, conn.conn_token.clone())
+        };
 
         if data_list.len() == 0 {
+            if close_conn {
+                self.close_connection(token);
+            }
             return;
         }
 
         let mut event_cmd = NetworkCommand::new();
+        let mut decode_failed = false;
         event_cmd.cmd = NetworkCMD::HandleEvent;
-        event_cmd.token = vec![conn_token];
         event_cmd.event.reserve_exact(data_list.len());
         for data in data_list {
-            event_cmd.event.push(match Event::from_raw(&data) {
+            event_cmd.event.push(match self.config.codec.decode(&data) {
                 Some(e) => e,
-                None => continue
+                None => {
+                    self.config.decode_failures.fetch_add(1, Ordering::Relaxed);
+                    Log::warn(format!("Unable to decode event from connection {}", NetHelper::escape_token(conn_token.as_str())).as_str()
+                              , format!("{} bytes", data.len()).as_str());
+                    if self.config.close_on_decode_failure {
+                        decode_failed = true;
+                        break;
+                    }
+                    continue
+                }
             });
         }
+        event_cmd.token = vec![conn_token];
+        event_cmd.conn_identity.push(ConnectionIdentity {
+            socket_type: SocketType::TCP,
+            handler_index: self.index,
+            socket_token: token,
+            generation: self.connections[token].generation
+        });
 
-        match self.net_chan.send(event_cmd) {
-            Ok(_) => {},
-            Err(e) => Log::error("Unable to send data over networking channel from TCP Reader", e.description())
+        // sending events decoded before failure anyway
+        if event_cmd.event.len() > 0 {
+            match self.net_chan.send(event_cmd) {
+                Ok(_) => {},
+                Err(e) => Log::error("Unable to send data over networking channel from TCP Reader", e.description())
+            }
+        }
+
+        if decode_failed {
+            self.connections[token].close_reason = CloseReason::Protocol(String::from("Unable to decode event"));
+            self.close_connection(token);
+        } else if close_conn {
+            self.close_connection(token);
         }
     }
 
     #[inline(always)]
     fn writable(&mut self, token: Token) {
+        let now = self.config.clock.now();
         let close_conn = {
             let ref mut conn = self.connections[token];
-            match conn.flush() {
+            // waiting until write limit allows to continue
+            if conn.write_throttled.is_some() {
+                return;
+            }
+
+            let max_bytes = match conn.write_limit {
+                Some(ref mut limit) => limit.available(now),
+                None => usize::MAX
+            };
+            let written = conn.bytes_written;
+            match conn.flush(max_bytes) {
                 Some(done) => {
-                    if done {
-                        // if we are done with flushing write queue
-                        // making connection readable again
-                        conn.make_readable(&self.poll);
+                    if conn.bytes_written != written {
+                        conn.last_write = now;
+                    }
+
+                    // rest of the queue would be written when limit allows it
+                    let wrote = (conn.bytes_written - written) as usize;
+                    if let Some(wait) = conn.write_limit.as_mut().and_then(|limit| limit.take(wrote, now)) {
+                        if !done {
+                            conn.write_throttled = Some(now + wait);
+                            self.throttled_count += 1;
+                        }
                     }
 
-                    false
+                    // if we have been requested to close connection
+                    // closing it as soon as write queue is empty
+                    if done && conn.close_after_write {
+                        // letting other side read all remaining data
+                        // and keeping connection open until other side closes it
+                        // or until close deadline, data which it sends after this is ignored
+                        conn.close_write();
+                        conn.write_closed = true;
+                        conn.close_reason = CloseReason::Local;
+                        conn.paused = false;
+                        conn.make_readable(&self.poll);
+                        // if this connection is closing without deadline
+                        // there is nothing to wait for
+                        conn.close_deadline.is_none()
+                    } else {
+                        if done {
+                            // if we are done with flushing write queue
+                            // making connection readable again
+                            conn.make_readable(&self.poll);
+                        }
+
+                        false
+                    }
                 },
                 None => true
             }
@@ -299,27 +717,134 @@ impl TcpHandler {
         }
     }
 
+    #[inline(always)]
+    fn has_timeouts(&self) -> bool {
+        self.config.read_timeout.is_some() || self.config.write_timeout.is_some()
+    }
+
+    /// Getting time when connection should be closed if nothing changes, with the reason for that
+    /// closing connection has only close deadline, others could have read and write timeouts
+    fn deadline(&self, conn: &TcpConnection) -> Option<(Instant, CloseReason)> {
+        if let Some(deadline) = conn.close_deadline {
+            return Some((deadline, CloseReason::CloseTimeout));
+        }
+
+        let handshake = conn.handshake_deadline.map(|deadline| (deadline, CloseReason::ConnectTimeout));
+
+        let read = match self.config.read_timeout {
+            // paused or throttled connection is not reading because we asked for it
+            Some(timeout) if conn.is_reading() => Some((conn.last_read + timeout, CloseReason::ReadTimeout)),
+            _ => None
+        };
+        let write = match self.config.write_timeout {
+            Some(timeout) if conn.has_writable_data() && conn.write_throttled.is_none() => Some((conn.last_write + timeout, CloseReason::WriteTimeout)),
+            _ => None
+        };
+
+        handshake.into_iter().chain(read).chain(write)
+            .min_by_key(|&(deadline, _)| deadline)
+    }
+
+    /// Getting time until the nearest connection deadline or end of throttling
+    /// None if there is nothing to wait for
+    fn deadline_wait(&self) -> Option<Duration> {
+        if self.deadline_count == 0 && self.throttled_count == 0 && !self.has_timeouts() {
+            return None;
+        }
+
+        let now = self.config.clock.now();
+        self.connections.iter()
+            .filter_map(|conn| {
+                let deadline = self.deadline(conn).map(|(deadline, _)| deadline);
+                deadline.into_iter().chain(conn.read_throttled).chain(conn.write_throttled).min()
+            })
+            .min()
+            .map(|deadline| if deadline > now { deadline - now } else { Duration::new(0, 0) })
+    }
+
+    /// Closing connections which didn't finish closing before their deadline
+    /// or didn't read or write anything during configured timeouts
+    fn close_expired(&mut self) {
+        let now = self.config.clock.now();
+        let expired: Vec<(Token, CloseReason)> = self.connections.iter()
+            .filter_map(|conn| match self.deadline(conn) {
+                Some((deadline, reason)) if deadline <= now => Some((conn.socket_token, reason)),
+                _ => None
+            })
+            .collect();
+
+        for (token, reason) in expired {
+            {
+                let ref mut conn = self.connections[token];
+                if reason == CloseReason::CloseTimeout {
+                    Log::warn("Connection didn't finish closing in time, closing it anyway"
+                              , NetHelper::escape_token(conn.conn_token.as_str()).as_str());
+                } else {
+                    Log::warn(format!("Closing connection {}", NetHelper::escape_token(conn.conn_token.as_str())).as_str()
+                              , format!("{}", reason).as_str());
+                }
+                conn.close_reason = reason;
+            }
+            self.close_connection(token);
+        }
+    }
+
     #[inline(always)]
     fn close_connection(&mut self, token: Token) {
         // sending command to Networking that connection closed
         // or at least one channel was closed for this connection
         {
             let ref conn = self.connections[token];
+            if conn.close_deadline.is_some() {
+                self.deadline_count -= 1;
+            }
+            if conn.handshake_deadline.is_some() {
+                self.deadline_count -= 1;
+            }
+            if conn.read_throttled.is_some() {
+                self.throttled_count -= 1;
+            }
+            if conn.write_throttled.is_some() {
+                self.throttled_count -= 1;
+            }
             // if we have accepted connection, notifying about close action
-            if Connection::check_api_version(conn.api_version) && conn.conn_token.len() > 0 {
+            if Connection::check_api_version(conn.api_version, self.config.api_version) && conn.conn_token.len() > 0 {
                 let mut net_cmd = NetworkCommand::new();
                 net_cmd.cmd = NetworkCMD::ConnectionClose;
                 net_cmd.token = vec![conn.conn_token.clone()];
                 net_cmd.conn_identity.push(ConnectionIdentity {
                     socket_type: SocketType::TCP,
                     handler_index: self.index,
-                    socket_token: token
+                    socket_token: token,
+                    generation: conn.generation
                 });
+                net_cmd.close_reason.push(conn.close_reason.clone());
+                net_cmd.bytes.push((conn.bytes_read, conn.bytes_written));
                 match self.net_chan.send(net_cmd) {
                     Ok(_) => {}
                     Err(e) => {
                         Log::error("Unable to send command to networking from TcpHandler"
-                                   , format!("Connection Close Command for Token - {} -> {}", conn.conn_token.clone(), e).as_str());
+                                   , format!("Connection Close Command for Token - {} -> {}", NetHelper::escape_token(conn.conn_token.as_str()), e).as_str());
+                    }
+                }
+            } else if conn.from_server {
+                // connection sent invalid handshake, letting Networking count it for remote IP
+                // connections closed without handshake, like health checks, are not counted
+                let failed = match conn.close_reason {
+                    CloseReason::Protocol(_) => true,
+                    _ => false
+                };
+                if let (true, Some(address)) = (failed, conn.remote_address) {
+                    let mut net_cmd = NetworkCommand::new();
+                    net_cmd.cmd = NetworkCMD::HandshakeFailed;
+                    net_cmd.address.push(address);
+                    net_cmd.close_reason.push(conn.close_reason.clone());
+                    match self.net_chan.send(net_cmd) {
+                        Ok(_) => {}
+                        Err(e) => {
+                            Log::error("Unable to send command to networking from TcpHandler"
+                                       , format!("Handshake Failed Command for {} -> {}", address, e).as_str());
+                        }
                     }
                 }
             }
@@ -333,7 +858,7 @@ impl TcpHandler {
         let mut close_conn = {
             let ref mut conn: TcpConnection = self.connections[token];
             // if we don't have yet API version defined
-            if !Connection::check_api_version(conn.api_version) {
+            if !Connection::check_api_version(conn.api_version, self.config.api_version) {
                 match conn.read_api_version() {
                     Some((done, version)) => {
                         // if we not done with reading API version
@@ -343,7 +868,9 @@ impl TcpHandler {
                         }
 
                         // if we got wrong API version just closing connection
-                        if !Connection::check_api_version(version) {
+                        if !Connection::check_api_version(version, self.config.api_version) {
+                            conn.close_reason = CloseReason::Protocol(format!("Unsupported API version {}, expecting {}"
+                                                                              , version, self.config.api_version));
                             true
                         } else {
                             // if we got valid API version
@@ -370,18 +897,57 @@ impl TcpHandler {
             let ref mut conn: TcpConnection = self.connections[token];
             // if we don't have token and value form connection
             if conn.conn_token.len() == 0 {
-                // reading Connection Token and Value
-                match conn.read_token_value() {
-                    Some((done, token_str, value)) => {
-                        // if we not done with reading API version
+                // reading Connection Token and Value chunk
+                let data = match conn.read_data_once(MAX_HANDSHAKE_DATA_LEN) {
+                    Some((done, data)) => {
+                        // if we not done with reading Token and Value
                         // Just returning and waiting until next readable cycle
                         if !done {
                             return false;
                         }
 
-                        // checking if we got valid Prime Value or not
+                        data
+                    }
+
+                    // if we have connection error closing it
+                    None => {
+                        self.close_connection(token);
+                        return false;
+                    }
+                };
+
+                let rejected = match conn.parse_token_value(&data) {
+                    Some((token_str, value)) => {
+                        // some clients are padding token with spaces or zero bytes
+                        // removing them before validation if it's allowed by configuration
+                        let token_str = if self.config.trim_tokens {
+                            let trimmed = String::from(token_str.trim_right_matches(|c: char| c.is_whitespace() || c == '\0'));
+                            if trimmed.len() != token_str.len() {
+                                Log::info("Trimmed padding from handshake token", NetHelper::escape_token(trimmed.as_str()).as_str());
+                            }
+                            trimmed
+                        } else {
+                            token_str
+                        };
+                        // without trimming padded token would be kept with padding
+                        // and it wouldn't match the same token sent without it
+                        let padded = !self.config.trim_tokens && !self.config.allow_raw_tokens
+                            && token_str.ends_with(|c: char| c.is_whitespace() || c == '\0');
+
+                        // checking if we got valid Prime Value and Token or not
                         // if it's invalid just closing connection
                         if !NetHelper::validate_value(value) {
+                            conn.close_reason = CloseReason::Protocol(format!("Invalid handshake Value {}", value));
+                            true
+                        } else if padded {
+                            Log::warn("Got padded token during handshake, closing connection"
+                                      , NetHelper::escape_token(token_str.as_str()).as_str());
+                            conn.close_reason = CloseReason::Protocol(String::from("Padded handshake Token"));
+                            true
+                        } else if !NetHelper::validate_token(token_str.as_str(), self.config.allow_raw_tokens) {
+                            Log::warn("Got invalid token during handshake, closing connection"
+                                      , NetHelper::escape_token(token_str.as_str()).as_str());
+                            conn.close_reason = CloseReason::Protocol(String::from("Invalid handshake Token"));
                             true
                         } else {
                             // if we done with token and value
@@ -394,9 +960,16 @@ impl TcpHandler {
                         }
                     }
 
-                    // if we have connection error closing it
                     None => true
+                };
+
+                // other side sent event instead of Token and Value
+                // giving clear reason for it, instead of complaining about Token or Value
+                if rejected && self.config.codec.decode(&data).is_some() {
+                    conn.close_reason = CloseReason::Protocol(String::from("frame before handshake"));
                 }
+
+                rejected
             } else {
                 false
             }
@@ -421,14 +994,767 @@ impl TcpHandler {
         net_cmd.conn_identity.push(ConnectionIdentity {
             handler_index: self.index,
             socket_type: SocketType::TCP,
-            socket_token: conn.socket_token
+            socket_token: conn.socket_token,
+            generation: conn.generation
         });
+        net_cmd.traffic.push(conn.traffic.clone());
+        // client connections are keeping address which we connected to
+        // so Networking could find parent connection by it
+        if !conn.from_server {
+            if let Some(address) = conn.remote_address {
+                net_cmd.address.push(address);
+            }
+        }
         match self.net_chan.send(net_cmd) {
             Ok(_) => {}
             Err(e) => {
                 Log::error("Unable to send command to networking from TcpHandler"
-                           , format!("New TCP connection Command for Token - {} -> {}", conn.conn_token.clone(), e).as_str());
+                           , format!("New TCP connection Command for Token - {} -> {}", NetHelper::escape_token(conn.conn_token.as_str()), e).as_str());
+            }
+        }
+    }
+}
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use super::mio::tcp::TcpStream;
+    use super::mio::channel::Receiver;
+    use event::{Event, RawEventCodec};
+    use helper::{SystemClock, FakeClock};
+    use std::net::{TcpListener, TcpStream as StdTcpStream};
+    use std::io::{Read, Write};
+    use std::thread;
+
+    fn config() -> TcpHandlerConfig {
+        TcpHandlerConfig {
+            api_version: 1,
+            allow_raw_tokens: false,
+            trim_tokens: false,
+            linger: None,
+            api_linger: None,
+            close_timeout: Duration::from_secs(5),
+            read_timeout: None,
+            write_timeout: None,
+            read_rate: None,
+            write_rate: None,
+            api_read_rate: None,
+            api_write_rate: None,
+            codec: Arc::new(RawEventCodec),
+            close_on_decode_failure: false,
+            decode_failures: Arc::new(AtomicUsize::new(0)),
+            mirror_dropped: Arc::new(AtomicUsize::new(0)),
+            clock: Arc::new(SystemClock)
+        }
+    }
+
+    fn handler() -> (TcpHandler, Receiver<NetworkCommand>) {
+        handler_with(config())
+    }
+
+    fn handler_with(config: TcpHandlerConfig) -> (TcpHandler, Receiver<NetworkCommand>) {
+        let (s, r) = channel::<NetworkCommand>();
+        (TcpHandler::new(s, 0, config), r)
+    }
+
+    /// Making connection look like it finished handshake
+    fn accept(handler: &mut TcpHandler, token: Token) {
+        let ref mut conn = handler.connections[token];
+        conn.api_version = 1;
+        conn.conn_token = String::from("peer");
+        conn.conn_value = 3;
+    }
+
+    /// Getting reason of the closed connection reported to Networking
+    fn close_reason(net: &Receiver<NetworkCommand>) -> Option<CloseReason> {
+        while let Ok(mut cmd) = net.try_recv() {
+            if let NetworkCMD::ConnectionClose = cmd.cmd {
+                return cmd.close_reason.pop();
+            }
+        }
+        None
+    }
+
+    /// Giving new server side connection to handler, returning its token and other side of it
+    fn add_connection(handler: &mut TcpHandler, listener: &TcpListener) -> (Token, StdTcpStream) {
+        let socket = TcpStream::connect(&listener.local_addr().unwrap()).unwrap();
+        let (peer, _) = listener.accept().unwrap();
+        let mut command = TcpHandlerCommand::new();
+        command.cmd = TcpHandlerCMD::HandleConnection;
+        command.conn.push(TcpConnection::new(socket, Token(0), true));
+        let before: Vec<Token> = handler.connections.iter().map(|c| c.socket_token).collect();
+        handler.notify(&mut command);
+        let token = handler.connections.iter().map(|c| c.socket_token)
+            .find(|t| !before.contains(t)).unwrap();
+        (token, peer)
+    }
+
+    fn command(cmd: TcpHandlerCMD, token: Token, generation: u64) -> TcpHandlerCommand {
+        let mut command = TcpHandlerCommand::new();
+        command.cmd = cmd;
+        command.token.push(token);
+        command.generation.push(generation);
+        command.data.push(Arc::new(vec![0, 0, 0, 1, 7]));
+        command
+    }
+
+    #[test]
+    fn stale_generation_ignored_after_slot_reuse() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, _net) = handler();
+
+        let (old_token, _old_peer) = add_connection(&mut handler, &listener);
+        let old_generation = handler.connections[old_token].generation;
+        handler.close_connection(old_token);
+
+        let (token, _peer) = add_connection(&mut handler, &listener);
+        assert!(token == old_token, "slot of closed connection is reused");
+        assert!(handler.connections[token].generation != old_generation);
+
+        // commands made for closed connection are not touching the new one
+        handler.notify(&mut command(TcpHandlerCMD::WriteData, token, old_generation));
+        handler.notify(&mut command(TcpHandlerCMD::MirrorData, token, old_generation));
+        handler.notify(&mut command(TcpHandlerCMD::CloseConnection, token, old_generation));
+        assert_eq!(handler.connections[token].writable_len(), 0);
+        assert!(!handler.connections[token].close_after_write);
+
+        let generation = handler.connections[token].generation;
+        handler.notify(&mut command(TcpHandlerCMD::WriteData, token, generation));
+        assert_eq!(handler.connections[token].writable_len(), 1);
+    }
+
+    #[test]
+    fn command_without_generation_ignored() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, _net) = handler();
+        let (token, _peer) = add_connection(&mut handler, &listener);
+
+        let mut cmd = command(TcpHandlerCMD::WriteData, token, 0);
+        cmd.generation.clear();
+        handler.notify(&mut cmd);
+        assert_eq!(handler.connections[token].writable_len(), 0);
+    }
+
+    #[test]
+    fn read_timeout_closes_idle_connection() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.read_timeout = Some(Duration::from_secs(10));
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler_with(config);
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+        accept(&mut handler, token);
+        assert_eq!(handler.deadline_wait(), Some(Duration::from_secs(10)));
+
+        clock.advance(Duration::from_secs(9));
+        handler.close_expired();
+        assert!(handler.connections.contains(token));
+
+        // reading is moving deadline forward
+        peer.write_all(&[0, 0, 0, 0]).unwrap();
+        handler.readable(token);
+        clock.advance(Duration::from_secs(9));
+        handler.close_expired();
+        assert!(handler.connections.contains(token));
+
+        clock.advance(Duration::from_secs(1));
+        handler.close_expired();
+        assert!(!handler.connections.contains(token));
+        assert_eq!(close_reason(&net), Some(CloseReason::ReadTimeout));
+    }
+
+    #[test]
+    fn read_timeout_ignores_paused_connection() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.read_timeout = Some(Duration::from_secs(10));
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, _net) = handler_with(config);
+        let (token, _peer) = add_connection(&mut handler, &listener);
+        let generation = handler.connections[token].generation;
+
+        handler.notify(&mut command(TcpHandlerCMD::PauseReading, token, generation));
+        clock.advance(Duration::from_secs(20));
+        handler.close_expired();
+        assert!(handler.connections.contains(token));
+    }
+
+    #[test]
+    fn write_timeout_closes_stalled_connection() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.write_timeout = Some(Duration::from_secs(10));
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler_with(config);
+        let (token, _peer) = add_connection(&mut handler, &listener);
+        accept(&mut handler, token);
+
+        // nothing to write, so nothing is stalled
+        assert_eq!(handler.deadline_wait(), None);
+        clock.advance(Duration::from_secs(20));
+        handler.close_expired();
+        assert!(handler.connections.contains(token));
+
+        // queued data is never flushed, because writable event is not handled
+        let generation = handler.connections[token].generation;
+        handler.notify(&mut command(TcpHandlerCMD::WriteData, token, generation));
+        clock.advance(Duration::from_secs(9));
+        handler.close_expired();
+        assert!(handler.connections.contains(token));
+
+        clock.advance(Duration::from_secs(1));
+        handler.close_expired();
+        assert!(!handler.connections.contains(token));
+        assert_eq!(close_reason(&net), Some(CloseReason::WriteTimeout));
+    }
+
+    #[test]
+    fn write_progress_moves_write_deadline() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.write_timeout = Some(Duration::from_secs(10));
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, _net) = handler_with(config);
+        let (token, _peer) = add_connection(&mut handler, &listener);
+        let generation = handler.connections[token].generation;
+
+        let mut cmd = command(TcpHandlerCMD::WriteData, token, generation);
+        cmd.data.push(Arc::new(vec![0, 0, 0, 1, 8]));
+        handler.notify(&mut cmd);
+        clock.advance(Duration::from_secs(9));
+        handler.writable(token);
+        assert!(!handler.connections[token].has_writable_data());
+
+        // queue is empty again, so there is no write deadline
+        clock.advance(Duration::from_secs(20));
+        handler.close_expired();
+        assert!(handler.connections.contains(token));
+    }
+
+    #[test]
+    fn handshake_deadline_closes_connection() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, _net) = handler_with(config);
+
+        // client connection to parent which is never answering handshake
+        let socket = TcpStream::connect(&listener.local_addr().unwrap()).unwrap();
+        let (_peer, _) = listener.accept().unwrap();
+        let mut conn = TcpConnection::new(socket, Token(0), false);
+        conn.handshake_deadline = Some(clock.now() + Duration::from_secs(10));
+        let mut cmd = TcpHandlerCommand::new();
+        cmd.cmd = TcpHandlerCMD::HandleConnection;
+        cmd.conn.push(conn);
+        handler.notify(&mut cmd);
+        assert_eq!(handler.deadline_wait(), Some(Duration::from_secs(10)));
+
+        clock.advance(Duration::from_secs(10));
+        handler.close_expired();
+        assert_eq!(handler.connections.len(), 0);
+        assert_eq!(handler.deadline_count, 0);
+        assert_eq!(handler.deadline_wait(), None);
+    }
+
+    #[test]
+    fn handshake_clears_handshake_deadline() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, _net) = handler_with(config);
+
+        let socket = TcpStream::connect(&listener.local_addr().unwrap()).unwrap();
+        let (mut peer, _) = listener.accept().unwrap();
+        let mut conn = TcpConnection::new(socket, Token(0), false);
+        conn.handshake_deadline = Some(clock.now() + Duration::from_secs(10));
+        let mut cmd = TcpHandlerCommand::new();
+        cmd.cmd = TcpHandlerCMD::HandleConnection;
+        cmd.conn.push(conn);
+        handler.notify(&mut cmd);
+        let token = handler.connections.iter().next().unwrap().socket_token;
+
+        // parent handshake, API version, token "p" and value 2
+        peer.write_all(&[0, 0, 0, 1, 0, 0, 0, 9, b'p', 0, 0, 0, 0, 0, 0, 0, 2]).unwrap();
+        handler.readable(token);
+        assert_eq!(handler.connections[token].conn_token, "p");
+        assert_eq!(handler.deadline_count, 0);
+
+        clock.advance(Duration::from_secs(10));
+        handler.close_expired();
+        assert!(handler.connections.contains(token));
+    }
+
+    /// Getting reason of the rejected handshake reported to Networking
+    fn handshake_failure(net: &Receiver<NetworkCommand>) -> Option<CloseReason> {
+        while let Ok(mut cmd) = net.try_recv() {
+            if let NetworkCMD::HandshakeFailed = cmd.cmd {
+                return cmd.close_reason.pop();
+            }
+        }
+        None
+    }
+
+    /// Reading from connection until handler closes it
+    fn read_until_closed(handler: &mut TcpHandler, token: Token) {
+        for _ in 0..100 {
+            if !handler.connections.contains(token) {
+                return;
+            }
+            handler.readable(token);
+        }
+        panic!("connection is not closed");
+    }
+
+    #[test]
+    fn frame_before_handshake_rejected() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler();
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+
+        // server is keeping address of accepted connections for counting failed handshakes
+        handler.connections[token].remote_address = Some(peer.local_addr().unwrap());
+        // API version and then event instead of Token and Value
+        let mut event = Event::default();
+        event.name = String::from("early");
+        event.from = String::from("peer");
+        event.data = vec![1, 2, 3, 4, 5, 6, 7, 8];
+        peer.write_all(&[0, 0, 0, 1]).unwrap();
+        event.write_to(&RawEventCodec, &mut peer).unwrap();
+
+        read_until_closed(&mut handler, token);
+        assert_eq!(handshake_failure(&net), Some(CloseReason::Protocol(String::from("frame before handshake"))));
+    }
+
+    #[test]
+    fn invalid_handshake_keeps_its_reason() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler();
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+
+        // server is keeping address of accepted connections for counting failed handshakes
+        handler.connections[token].remote_address = Some(peer.local_addr().unwrap());
+        // token "p" with value 9, which is not a prime
+        peer.write_all(&[0, 0, 0, 1, 0, 0, 0, 9, b'p', 0, 0, 0, 0, 0, 0, 0, 9]).unwrap();
+        read_until_closed(&mut handler, token);
+        assert_eq!(handshake_failure(&net), Some(CloseReason::Protocol(String::from("Invalid handshake Value 9"))));
+    }
+
+    /// Sending handshake with token padded by space and zero byte
+    fn padded_handshake(trim: bool) -> (TcpHandler, Token, Receiver<NetworkCommand>) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let mut config = config();
+        config.trim_tokens = trim;
+        let (mut handler, net) = handler_with(config);
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+        handler.connections[token].remote_address = Some(peer.local_addr().unwrap());
+
+        peer.write_all(&[0, 0, 0, 1, 0, 0, 0, 14, b'p', b'e', b'e', b'r', b' ', 0, 0, 0, 0, 0, 0, 0, 0, 2]).unwrap();
+        for _ in 0..100 {
+            if !handler.connections.contains(token) || handler.connections[token].conn_token.len() > 0 {
+                break;
+            }
+            handler.readable(token);
+        }
+        (handler, token, net)
+    }
+
+    #[test]
+    fn padded_token_rejected_without_trimming() {
+        let (handler, token, net) = padded_handshake(false);
+        assert!(!handler.connections.contains(token));
+        assert_eq!(handshake_failure(&net), Some(CloseReason::Protocol(String::from("Padded handshake Token"))));
+    }
+
+    #[test]
+    fn padded_token_trimmed() {
+        let (handler, token, net) = padded_handshake(true);
+        assert_eq!(handler.connections[token].conn_token, "peer");
+        assert!(handshake_failure(&net).is_none());
+    }
+
+    #[test]
+    fn other_api_version_rejected() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler();
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+        handler.connections[token].remote_address = Some(peer.local_addr().unwrap());
+
+        // valid handshake of API version 2, while handler is using version 1
+        peer.write_all(&[0, 0, 0, 2, 0, 0, 0, 9, b'p', 0, 0, 0, 0, 0, 0, 0, 2]).unwrap();
+        read_until_closed(&mut handler, token);
+        assert_eq!(handshake_failure(&net), Some(CloseReason::Protocol(String::from("Unsupported API version 2, expecting 1"))));
+    }
+
+    #[test]
+    fn event_after_handshake_delivered() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler();
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+
+        // handshake and event in the same read
+        let mut event = Event::default();
+        event.name = String::from("first");
+        let mut data = vec![0, 0, 0, 1, 0, 0, 0, 9, b'p', 0, 0, 0, 0, 0, 0, 0, 2];
+        event.write_to(&RawEventCodec, &mut data).unwrap();
+        peer.write_all(&data).unwrap();
+
+        let mut names = vec![];
+        for _ in 0..100 {
+            handler.readable(token);
+            while let Ok(cmd) = net.try_recv() {
+                names.extend(cmd.event.iter().map(|e| e.name.clone()));
+            }
+            if names.len() > 0 {
+                break;
+            }
+        }
+        assert_eq!(names, vec![String::from("first")]);
+        assert!(handler.connections.contains(token));
+    }
+
+    /// Moving fake clock to the end of throttling and resuming connection
+    fn wait_throttled(handler: &mut TcpHandler, clock: &FakeClock, until: Instant) {
+        let now = clock.now();
+        if until > now {
+            clock.advance(until - now);
+        }
+        handler.resume_throttled();
+    }
+
+    #[test]
+    fn read_rate_is_paced() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler_with(config);
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+        accept(&mut handler, token);
+        handler.set_rate_limit(token, Some(1000), None);
+
+        let mut event = Event::default();
+        event.name = String::from("chunk");
+        event.data = vec![7; 500];
+        let mut sent = 0;
+        for _ in 0..20 {
+            sent += event.write_to(&RawEventCodec, &mut peer).unwrap();
+        }
+
+        let started = clock.now();
+        let mut events = 0;
+        for _ in 0..1000 {
+            if handler.connections[token].bytes_read as usize >= sent {
+                break;
+            }
+
+            match handler.connections[token].read_throttled {
+                Some(until) => wait_throttled(&mut handler, &clock, until),
+                None => handler.readable(token)
+            }
+
+            // limit is allowing one second burst and one chunk over the limit
+            let elapsed = clock.now() - started;
+            let elapsed = elapsed.as_secs() as f64 + elapsed.subsec_nanos() as f64 / 1e9;
+            let chunk = sent / 20;
+            assert!(handler.connections[token].bytes_read as f64 <= 1000.0 + 1000.0 * elapsed + chunk as f64);
+        }
+
+        while let Ok(cmd) = net.try_recv() {
+            events += cmd.event.len();
+        }
+        assert_eq!(events, 20);
+        assert!(clock.now() - started >= Duration::from_secs((sent as u64 - 1000 - sent as u64 / 20) / 1000));
+    }
+
+    #[test]
+    fn write_rate_is_paced() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, _net) = handler_with(config);
+        let (token, _peer) = add_connection(&mut handler, &listener);
+        handler.set_rate_limit(token, None, Some(1000));
+
+        let generation = handler.connections[token].generation;
+        let mut cmd = command(TcpHandlerCMD::WriteData, token, generation);
+        cmd.data = (0..10).map(|_| Arc::new(vec![1; 500])).collect();
+        handler.notify(&mut cmd);
+
+        let started = clock.now();
+        for _ in 0..1000 {
+            if !handler.connections[token].has_writable_data() {
+                break;
+            }
+
+            match handler.connections[token].write_throttled {
+                Some(until) => wait_throttled(&mut handler, &clock, until),
+                None => handler.writable(token)
             }
+
+            let elapsed = clock.now() - started;
+            let elapsed = elapsed.as_secs() as f64 + elapsed.subsec_nanos() as f64 / 1e9;
+            assert!(handler.connections[token].bytes_written as f64 <= 1000.0 + 1000.0 * elapsed);
         }
+
+        assert_eq!(handler.connections[token].bytes_written, 5000);
+        assert!(clock.now() - started >= Duration::from_secs(4));
+        assert_eq!(handler.throttled_count, 0);
+    }
+
+    #[test]
+    fn rate_limit_command() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, _net) = handler();
+        let (token, _peer) = add_connection(&mut handler, &listener);
+        let generation = handler.connections[token].generation;
+
+        let mut data = vec![0; 16];
+        NetHelper::u64_to_bytes(1000, &mut data, 0);
+        let mut cmd = command(TcpHandlerCMD::SetRateLimit, token, generation);
+        cmd.data = vec![Arc::new(data)];
+        handler.notify(&mut cmd);
+        assert_eq!(handler.connections[token].read_limit.as_ref().map(|l| l.rate), Some(1000));
+        // 0 is unlimited
+        assert!(handler.connections[token].write_limit.is_none());
+
+        // invalid rates are not changing anything
+        let mut cmd = command(TcpHandlerCMD::SetRateLimit, token, generation);
+        cmd.data = vec![Arc::new(vec![0; 8])];
+        handler.notify(&mut cmd);
+        assert!(handler.connections[token].read_limit.is_some());
+    }
+
+    /// Requesting close of accepted connection with goodbye data
+    fn request_close(handler: &mut TcpHandler, token: Token, goodbye: &[u8]) {
+        let generation = handler.connections[token].generation;
+        let mut cmd = command(TcpHandlerCMD::CloseConnection, token, generation);
+        cmd.data = vec![Arc::new(Vec::from(goodbye))];
+        handler.notify(&mut cmd);
+        handler.writable(token);
+        assert!(handler.connections[token].write_closed);
+    }
+
+    #[test]
+    fn acknowledged_close() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler_with(config);
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+        accept(&mut handler, token);
+
+        request_close(&mut handler, token, &[0, 0, 0, 1, 9]);
+
+        // other side is reading goodbye and EOF after it, then closing its side
+        let mut received = vec![];
+        peer.read_to_end(&mut received).unwrap();
+        assert_eq!(received, vec![0, 0, 0, 1, 9]);
+        drop(peer);
+
+        handler.readable(token);
+        assert!(!handler.connections.contains(token));
+        assert_eq!(close_reason(&net), Some(CloseReason::Local));
+        assert_eq!(handler.deadline_count, 0);
     }
-}
\ No newline at end of file
+
+    #[test]
+    fn unacknowledged_close() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler_with(config);
+        let (token, _peer) = add_connection(&mut handler, &listener);
+        accept(&mut handler, token);
+
+        // other side is keeping connection open
+        request_close(&mut handler, token, &[0, 0, 0, 1, 9]);
+        clock.advance(Duration::from_secs(4));
+        handler.close_expired();
+        assert!(handler.connections.contains(token));
+
+        clock.advance(Duration::from_secs(1));
+        handler.close_expired();
+        assert!(!handler.connections.contains(token));
+        assert_eq!(close_reason(&net), Some(CloseReason::CloseTimeout));
+    }
+
+    /// Queueing data chunks for writing and then closing with goodbye data
+    /// returning all bytes which other side should get
+    fn queue_and_close(handler: &mut TcpHandler, token: Token, chunks: usize, chunk_len: usize) -> Vec<u8> {
+        let generation = handler.connections[token].generation;
+        let mut expected = vec![];
+        for i in 0..chunks {
+            let chunk = vec![i as u8; chunk_len];
+            expected.extend_from_slice(chunk.as_slice());
+            let mut cmd = command(TcpHandlerCMD::WriteData, token, generation);
+            cmd.data = vec![Arc::new(chunk)];
+            handler.notify(&mut cmd);
+        }
+
+        let mut cmd = command(TcpHandlerCMD::CloseConnection, token, generation);
+        expected.extend_from_slice(&[0, 0, 0, 1, 9]);
+        cmd.data = vec![Arc::new(vec![0, 0, 0, 1, 9])];
+        handler.notify(&mut cmd);
+        expected
+    }
+
+    #[test]
+    fn queued_data_delivered_before_close() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler();
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+        accept(&mut handler, token);
+
+        // more than socket buffers could keep, so it's written in many cycles
+        let expected = queue_and_close(&mut handler, token, 16, 256 * 1024);
+        let reader = thread::spawn(move || {
+            let mut received = vec![];
+            peer.read_to_end(&mut received).unwrap();
+            (received, peer)
+        });
+
+        for _ in 0..100000 {
+            if handler.connections[token].write_closed {
+                break;
+            }
+            handler.writable(token);
+            thread::yield_now();
+        }
+        assert!(handler.connections[token].write_closed);
+
+        // EOF comes only after all queued data
+        let (received, peer) = reader.join().unwrap();
+        assert!(received == expected);
+        drop(peer);
+
+        handler.readable(token);
+        assert!(!handler.connections.contains(token));
+        assert_eq!(close_reason(&net), Some(CloseReason::Local));
+    }
+
+    #[test]
+    fn written_data_delivered_after_close_timeout() {
+        let clock = Arc::new(FakeClock::new());
+        let mut config = config();
+        config.clock = clock.clone();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, net) = handler_with(config);
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+        accept(&mut handler, token);
+
+        // other side is not reading and not closing during close timeout
+        let expected = queue_and_close(&mut handler, token, 4, 1024);
+        handler.writable(token);
+        assert!(handler.connections[token].write_closed);
+        clock.advance(Duration::from_secs(5));
+        handler.close_expired();
+        assert!(!handler.connections.contains(token));
+        assert_eq!(close_reason(&net), Some(CloseReason::CloseTimeout));
+
+        // data written before timeout is still delivered, followed by EOF
+        let mut received = vec![];
+        peer.read_to_end(&mut received).unwrap();
+        assert!(received == expected);
+    }
+
+    #[test]
+    fn mirror_data_dropped_when_queue_is_full() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let (mut handler, _net) = handler();
+        let (token, _peer) = add_connection(&mut handler, &listener);
+        let generation = handler.connections[token].generation;
+
+        handler.notify(&mut command(TcpHandlerCMD::MirrorData, token, generation));
+        assert_eq!(handler.connections[token].writable_len(), 1);
+
+        // slow standby is not growing write queue after limit
+        for _ in 1..MIRROR_QUEUE_LIMIT {
+            handler.connections[token].add_writable_data(Arc::new(vec![0, 0, 0, 1, 7]));
+        }
+        handler.notify(&mut command(TcpHandlerCMD::MirrorData, token, generation));
+        handler.notify(&mut command(TcpHandlerCMD::MirrorData, token, generation));
+        assert_eq!(handler.connections[token].writable_len(), MIRROR_QUEUE_LIMIT);
+        assert_eq!(handler.config.mirror_dropped.load(Ordering::Relaxed), 2);
+
+        // regular writes are not limited
+        handler.notify(&mut command(TcpHandlerCMD::WriteData, token, generation));
+        assert_eq!(handler.connections[token].writable_len(), MIRROR_QUEUE_LIMIT + 1);
+    }
+
+    /// Codec which is failing to decode events named "bad"
+    struct FailingCodec;
+
+    impl EventCodec for FailingCodec {
+        fn encode(&self, event: &Event) -> Option<Vec<u8>> {
+            event.to_raw()
+        }
+
+        fn decode(&self, data: &Vec<u8>) -> Option<Event> {
+            Event::from_raw(data).and_then(|e| if e.name == "bad" { None } else { Some(e) })
+        }
+    }
+
+    /// Sending events with given names from peer and reading them by handler
+    /// returning names of delivered events and close reason if connection was closed
+    fn decode_events(close_on_failure: bool, names: &[&str]) -> (Vec<String>, Option<CloseReason>, usize) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let mut config = config();
+        config.codec = Arc::new(FailingCodec);
+        config.close_on_decode_failure = close_on_failure;
+        let (mut handler, net) = handler_with(config);
+        let (token, mut peer) = add_connection(&mut handler, &listener);
+        accept(&mut handler, token);
+
+        for name in names {
+            let mut event = Event::default();
+            event.name = String::from(*name);
+            event.write_to(&RawEventCodec, &mut peer).unwrap();
+        }
+
+        let mut delivered = vec![];
+        let mut reason = None;
+        for _ in 0..100 {
+            if !handler.connections.contains(token) {
+                break;
+            }
+            handler.readable(token);
+            while let Ok(mut cmd) = net.try_recv() {
+                match cmd.cmd {
+                    NetworkCMD::HandleEvent => delivered.extend(cmd.event.iter().map(|e| e.name.clone())),
+                    NetworkCMD::ConnectionClose => reason = cmd.close_reason.pop(),
+                    _ => {}
+                }
+            }
+            if delivered.len() + 1 >= names.len() && (reason.is_some() || !close_on_failure) {
+                break;
+            }
+        }
+
+        (delivered, reason, handler.config.decode_failures.load(Ordering::Relaxed))
+    }
+
+    #[test]
+    fn decode_failure_skipped() {
+        let (delivered, reason, failures) = decode_events(false, &["first", "bad", "last"]);
+        assert_eq!(delivered, vec![String::from("first"), String::from("last")]);
+        assert!(reason.is_none());
+        assert_eq!(failures, 1);
+    }
+
+    #[test]
+    fn decode_failure_closes_connection() {
+        let (delivered, reason, failures) = decode_events(true, &["first", "bad", "last"]);
+        // events decoded before failure are delivered anyway
+        assert_eq!(delivered, vec![String::from("first")]);
+        assert_eq!(reason, Some(CloseReason::Protocol(String::from("Unable to decode event"))));
+        assert_eq!(failures, 1);
+    }
+}
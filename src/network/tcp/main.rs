@@ -1,7 +1,7 @@
 #![allow(dead_code)]
 extern crate mio;
 
-use helper::Log;
+use helper::{Log, Backoff};
 
 use self::mio::tcp::{TcpListener, TcpStream};
 use self::mio::{Ready, PollOpt, Token};
@@ -10,16 +10,114 @@ use self::mio::channel::Sender;
 use node::{Node, NET_TCP_SERVER_TOKEN};
 use network::{TcpConnection
               , TcpHandler, Networking
-              , TcpHandlerCommand, TcpHandlerCMD};
+              , TcpHandlerCommand, TcpHandlerCMD, Socks5Proxy};
 
 
 use std::net::SocketAddr;
+use std::net;
+use std::env;
 use std::error::Error;
 use std::process;
 use std::str::FromStr;
 use std::io::ErrorKind;
 use std::thread;
 use std::sync::Arc;
+use std::sync::atomic::Ordering;
+use std::time::{Duration, Instant};
+
+/// Callback for deciding to accept TCP connection or not
+/// using only remote address, before reading any handshake information
+pub type TcpAcceptHook = Box<Fn(&SocketAddr) -> bool>;
+
+/// Delays between TCP server bind attempts when address is in use
+const TCP_BIND_RETRY_BASE_MS: u64 = 100;
+const TCP_BIND_RETRY_MAX_MS: u64 = 2000;
+
+/// Process exit code when TCP server address is still in use after retrying
+/// so supervisor could tell it apart from other startup errors
+const TCP_BIND_IN_USE_EXIT_CODE: i32 = 3;
+
+/// First file descriptor passed by systemd socket activation
+const SYSTEMD_LISTEN_FDS_START: i32 = 3;
+
+/// Getting listener passed by systemd socket activation
+/// Returns None if process is not socket activated
+#[cfg(unix)]
+fn systemd_listener() -> Option<net::TcpListener> {
+    activated_listener("LISTEN_PID", "LISTEN_FDS", SYSTEMD_LISTEN_FDS_START)
+}
+
+/// Getting first socket passed with given PID and file descriptors count environment variables
+/// variables are removed after that, so child processes are not thinking that sockets are for them
+#[cfg(unix)]
+fn activated_listener(pid_var: &str, fds_var: &str, first_fd: i32) -> Option<net::TcpListener> {
+    use std::os::unix::io::FromRawFd;
+
+    // LISTEN_PID should match our process, otherwise variables are inherited from parent process
+    let pid_matches = match env::var(pid_var) {
+        Ok(pid) => pid.parse::<u32>().ok() == Some(process::id()),
+        Err(_) => false
+    };
+
+    let fds = match env::var(fds_var) {
+        Ok(fds) => fds.parse::<i32>().unwrap_or(0),
+        Err(_) => 0
+    };
+
+    env::remove_var(pid_var);
+    env::remove_var(fds_var);
+
+    if !pid_matches || fds < 1 {
+        return None;
+    }
+
+    if fds > 1 {
+        Log::warn("Got more than one socket from systemd", "Using only the first one as a TCP server");
+    }
+
+    Some(unsafe { net::TcpListener::from_raw_fd(first_fd) })
+}
+
+#[cfg(not(unix))]
+fn systemd_listener() -> Option<net::TcpListener> {
+    None
+}
+
+/// Error of binding TCP server address
+#[derive(Debug)]
+pub enum TcpBindError {
+    // address is still in use after retrying during given time
+    InUse(Duration),
+    // any other bind error, which is not retried
+    Failed(String)
+}
+
+/// Binding TCP server to given address
+/// previous process could still hold this address during restart
+/// so trying again until retry time is over
+fn bind_tcp_server(addr: &SocketAddr, bind_retry: Duration) -> Result<TcpListener, TcpBindError> {
+    let started = Instant::now();
+    let backoff = Backoff::new(Duration::from_millis(TCP_BIND_RETRY_BASE_MS)
+                               , Duration::from_millis(TCP_BIND_RETRY_MAX_MS), 0.0);
+    let mut attempt = 0;
+    loop {
+        match TcpListener::bind(addr) {
+            Ok(s) => return Ok(s),
+            Err(e) => {
+                if e.kind() != ErrorKind::AddrInUse {
+                    return Err(TcpBindError::Failed(format!("{}", e)));
+                }
+
+                if started.elapsed() >= bind_retry {
+                    return Err(TcpBindError::InUse(bind_retry));
+                }
+
+                thread::sleep(backoff.delay(attempt, 0.0));
+                attempt += 1;
+            }
+        }
+    }
+}
 
 /// TcpNetwork Trait for implementing TCP networking capabilities
 /// On top of Node structure
@@ -28,7 +126,13 @@ pub trait TcpNetwork {
     fn register_tcp(&mut self);
 
     /// Make TCP server socket listener from given address
-    fn make_tcp_server(address: &str) -> TcpListener;
+    /// or use socket passed by systemd socket activation
+    /// If address is in use, retrying during "bind_retry" time
+    fn make_tcp_server(address: &str, bind_retry: Duration) -> TcpListener;
+
+    /// Make SOCKS5 proxy information from given address and "user:password" credentials
+    /// Returns None if there is no proxy address
+    fn make_tcp_proxy(address: &str, auth: &str) -> Option<Socks5Proxy>;
 
     /// Handler for event loop ready event
     /// This is general event processing for TCP connections/servers
@@ -39,15 +143,30 @@ pub trait TcpNetwork {
     /// Function for accepting TCP connections as a pending connections
     fn tcp_acceptable(&mut self);
 
+    /// Setting callback which would be called for each accepted connection
+    /// if callback returns false connection would be closed immediately
+    fn set_tcp_accept_hook(&mut self, hook: TcpAcceptHook);
+
     /// getting one of the TCP handler channels
     /// using Round Rubin algorithm
     fn tcp_get_handler(&mut self) -> Sender<TcpHandlerCommand>;
 
     /// making client connection to given address
+    /// with deadline based on "connect_timeout" if it's configured
+    /// over SOCKS5 proxy this is blocking Node thread until proxy handshake is done or timed out
     fn tcp_connect(&mut self, address: &str) -> bool;
 
+    /// making client connection to given address, which should finish before deadline
+    /// returns false if connection or proxy handshake don't finish in time,
+    /// if API handshake is not done in time TcpHandler closes connection
+    fn tcp_connect_before(&mut self, address: &str, deadline: Option<Instant>) -> bool;
+
     /// Transferring connection from pending to one of the TCP handlers
-    fn tcp_transfer_connection(&mut self, sock: TcpStream, from_server: bool);
+    /// not accepted connection is closed by handler after "deadline" if it's set
+    fn tcp_transfer_connection(&mut self, sock: TcpStream, from_server: bool, address: SocketAddr, deadline: Option<Instant>);
+
+    /// Getting count of received data chunks which TCP handlers couldn't decode as events
+    fn tcp_decode_failures(&self) -> usize;
 }
 
 impl TcpNetwork for Node {
@@ -68,15 +187,38 @@ impl TcpNetwork for Node {
         }
 
         for i in 0..handlers_count {
-            let mut handler = TcpHandler::new(self.net_sender_chan.clone(), i);
+            let mut handler = TcpHandler::new(self.net_sender_chan.clone(), i, self.net_tcp_handler_config.clone());
             self.net_tcp_handler_sender_chan.push(handler.channel());
             thread::spawn(move || {
                 handler.start();
             });
         }
+
+        self.net_tcp_listening = true;
+        self.update_ready();
     }
 
-    fn make_tcp_server(address: &str) -> TcpListener {
+    fn make_tcp_server(address: &str, bind_retry: Duration) -> TcpListener {
+        // if we got already bound socket from systemd using it
+        // instead of binding to given address
+        if let Some(listener) = systemd_listener() {
+            let addr = match listener.local_addr() {
+                Ok(a) => a,
+                Err(e) => {
+                    Log::error("Unable to use TCP server socket passed by systemd", e.description());
+                    process::exit(1);
+                }
+            };
+
+            return match TcpListener::from_listener(listener, &addr) {
+                Ok(s) => s,
+                Err(e) => {
+                    Log::error("Unable to use TCP server socket passed by systemd", e.description());
+                    process::exit(1);
+                }
+            };
+        }
+
         let addr = match SocketAddr::from_str(address) {
             Ok(a) => a,
             Err(e) => {
@@ -85,15 +227,50 @@ impl TcpNetwork for Node {
             }
         };
 
-        match TcpListener::bind(&addr) {
+        match bind_tcp_server(&addr, bind_retry) {
             Ok(s) => s,
-            Err(e) => {
-                Log::error("Unable to bind given TCP server address", e.description());
+            Err(TcpBindError::InUse(retried)) => {
+                Log::error("Unable to bind given TCP server address, it is still in use"
+                           , format!("{} after retrying for {}s", address, retried.as_secs()).as_str());
+                process::exit(TCP_BIND_IN_USE_EXIT_CODE);
+            }
+            Err(TcpBindError::Failed(e)) => {
+                Log::error("Unable to bind given TCP server address", e.as_str());
                 process::exit(1);
             }
         }
     }
 
+    fn make_tcp_proxy(address: &str, auth: &str) -> Option<Socks5Proxy> {
+        if address.len() == 0 {
+            return None;
+        }
+
+        let addr = match SocketAddr::from_str(address) {
+            Ok(a) => a,
+            Err(e) => {
+                Log::error("Unable to parse given SOCKS5 proxy address", e.description());
+                process::exit(1);
+            }
+        };
+
+        // credentials are optional, but if they are set
+        // they should be in "user:password" format
+        let (username, password) = match auth.find(':') {
+            Some(i) => (String::from(&auth[..i]), String::from(&auth[i + 1..])),
+            None => {
+                if auth.len() > 0 {
+                    Log::error("Unable to parse given SOCKS5 proxy credentials", "Expecting USER:PASSWORD format");
+                    process::exit(1);
+                }
+
+                (String::new(), String::new())
+            }
+        };
+
+        Some(Socks5Proxy::new(addr, username, password))
+    }
+
     #[inline(always)]
     fn tcp_ready(&mut self, token: Token, event_kind: Ready) -> bool {
         if token == NET_TCP_SERVER_TOKEN {
@@ -112,8 +289,8 @@ impl TcpNetwork for Node {
     #[inline(always)]
     fn tcp_acceptable(&mut self) {
         loop {
-            let sock = match self.net_tcp_server.accept() {
-                Ok((s, _)) => s,
+            let (sock, address) = match self.net_tcp_server.accept() {
+                Ok((s, a)) => (s, a),
                 Err(e) => {
                     // if we got WouldBlock, then this is Non Blocking socket
                     // and data still not available for this, so it's not a connection error
@@ -124,10 +301,32 @@ impl TcpNetwork for Node {
                 }
             };
 
-            self.tcp_transfer_connection(sock, true);
+            // rejecting before any data if this IP failed handshake too many times
+            if !self.net_tcp_handshake_guard.allowed(&address.ip()) {
+                Log::info("Rejecting TCP connection from blocked IP", format!("{}", address).as_str());
+                continue;
+            }
+
+            let accepted = match self.net_tcp_accept_hook {
+                Some(ref hook) => hook(&address),
+                None => true
+            };
+
+            // dropping socket will close connection
+            if !accepted {
+                Log::info("Rejecting TCP connection by accept hook", format!("{}", address).as_str());
+                continue;
+            }
+
+            self.tcp_transfer_connection(sock, true, address, None);
         };
     }
 
+    #[inline(always)]
+    fn set_tcp_accept_hook(&mut self, hook: TcpAcceptHook) {
+        self.net_tcp_accept_hook = Some(hook);
+    }
+
     #[inline(always)]
     fn tcp_get_handler(&mut self) -> Sender<TcpHandlerCommand> {
         if self.net_tcp_handler_index >= self.net_tcp_handler_sender_chan.len() {
@@ -142,6 +341,11 @@ impl TcpNetwork for Node {
 
     #[inline(always)]
     fn tcp_connect(&mut self, address: &str) -> bool {
+        let deadline = self.net_tcp_connect_timeout.map(|timeout| self.clock.now() + timeout);
+        self.tcp_connect_before(address, deadline)
+    }
+
+    fn tcp_connect_before(&mut self, address: &str, deadline: Option<Instant>) -> bool {
         let sock_address = match SocketAddr::from_str(address) {
             Ok(a) => a,
             Err(e) => {
@@ -150,23 +354,45 @@ impl TcpNetwork for Node {
             }
         };
 
-        let sock = match TcpStream::connect(&sock_address) {
-            Ok(s) => s,
-            Err(e) => {
-                Log::error(format!("Unable to connect with given tcp address {}", address).as_str(), e.description());
-                return false;
+        let sock = match self.net_tcp_proxy {
+            // proxy handshake is blocking, so after it we are converting
+            // connected stream to non blocking one for our POLL services
+            Some(ref proxy) => match proxy.connect_before(&sock_address, deadline) {
+                Ok(s) => match TcpStream::from_stream(s) {
+                    Ok(ss) => ss,
+                    Err(e) => {
+                        Log::error(format!("Unable to use proxied connection for tcp address {}", address).as_str(), e.description());
+                        return false;
+                    }
+                },
+                Err(e) => {
+                    Log::error(format!("Unable to connect with given tcp address {} over SOCKS5 proxy", address).as_str(), e.description());
+                    return false;
+                }
+            },
+
+            // direct connect is not blocking, it's finishing on TcpHandler
+            // so it's covered by handshake deadline there
+            None => match TcpStream::connect(&sock_address) {
+                Ok(s) => s,
+                Err(e) => {
+                    Log::error(format!("Unable to connect with given tcp address {}", address).as_str(), e.description());
+                    return false;
+                }
             }
         };
 
-        self.tcp_transfer_connection(sock, false);
+        self.tcp_transfer_connection(sock, false, sock_address, deadline);
         true
     }
 
     #[inline(always)]
-    fn tcp_transfer_connection(&mut self, sock: TcpStream, from_server: bool) {
+    fn tcp_transfer_connection(&mut self, sock: TcpStream, from_server: bool, address: SocketAddr, deadline: Option<Instant>) {
         let mut command = TcpHandlerCommand::new();
         command.cmd = TcpHandlerCMD::HandleConnection;
         command.conn.push(TcpConnection::new(sock, Token(0), from_server));
+        command.conn[0].remote_address = Some(address);
+        command.conn[0].handshake_deadline = deadline;
         // adding handshake info, for writing it later from handler
         command.conn[0].add_writable_data(Arc::new(self.handshake_info()));
         match self.tcp_get_handler().send(command) {
@@ -177,5 +403,100 @@ impl TcpNetwork for Node {
             }
         }
     }
+
+    #[inline(always)]
+    fn tcp_decode_failures(&self) -> usize {
+        self.net_tcp_handler_config.decode_failures.load(Ordering::Relaxed)
+    }
 }
 
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use node::testing::{self, Peer};
+
+    #[test]
+    #[cfg(unix)]
+    fn activated_listener_is_taken_once() {
+        use std::os::unix::io::IntoRawFd;
+
+        let bound = net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = bound.local_addr().unwrap();
+        let fd = bound.into_raw_fd();
+        env::set_var("TEST_TAKEN_LISTEN_PID", format!("{}", process::id()));
+        env::set_var("TEST_TAKEN_LISTEN_FDS", "1");
+
+        let listener = activated_listener("TEST_TAKEN_LISTEN_PID", "TEST_TAKEN_LISTEN_FDS", fd).unwrap();
+        assert_eq!(listener.local_addr().unwrap(), addr);
+        assert!(env::var("TEST_TAKEN_LISTEN_PID").is_err());
+        assert!(env::var("TEST_TAKEN_LISTEN_FDS").is_err());
+        assert!(activated_listener("TEST_TAKEN_LISTEN_PID", "TEST_TAKEN_LISTEN_FDS", fd).is_none());
+
+        // and it's usable as a Node server socket
+        assert!(TcpListener::from_listener(listener, &addr).is_ok());
+    }
+
+    #[test]
+    #[cfg(unix)]
+    fn activated_listener_of_other_process_ignored() {
+        env::set_var("TEST_OTHER_LISTEN_PID", format!("{}", process::id() + 1));
+        env::set_var("TEST_OTHER_LISTEN_FDS", "1");
+
+        assert!(activated_listener("TEST_OTHER_LISTEN_PID", "TEST_OTHER_LISTEN_FDS", -1).is_none());
+        assert!(env::var("TEST_OTHER_LISTEN_PID").is_err());
+        assert!(env::var("TEST_OTHER_LISTEN_FDS").is_err());
+    }
+
+    #[test]
+    fn bind_waits_until_address_is_released() {
+        let held = net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = held.local_addr().unwrap();
+        let releaser = thread::spawn(move || {
+            thread::sleep(Duration::from_millis(300));
+            drop(held);
+        });
+
+        let started = Instant::now();
+        let server = bind_tcp_server(&addr, Duration::from_secs(5)).unwrap();
+        assert!(started.elapsed() >= Duration::from_millis(300));
+        assert_eq!(server.local_addr().unwrap(), addr);
+        releaser.join().unwrap();
+    }
+
+    #[test]
+    fn bind_gives_up_while_address_is_in_use() {
+        let held = net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = held.local_addr().unwrap();
+
+        match bind_tcp_server(&addr, Duration::from_millis(200)) {
+            Err(TcpBindError::InUse(retried)) => assert_eq!(retried, Duration::from_millis(200)),
+            _ => panic!("expected address in use error")
+        }
+        match bind_tcp_server(&addr, Duration::from_secs(0)) {
+            Err(TcpBindError::InUse(_)) => {}
+            _ => panic!("expected address in use error without retry")
+        }
+    }
+
+    #[test]
+    fn accept_hook_rejects_before_handshake() {
+        let mut node = testing::node(&[]);
+        node.set_tcp_accept_hook(Box::new(|_: &SocketAddr| false));
+        let mut peer = Peer::connect_raw(&node, "child", 3);
+
+        testing::run_for(&mut node, Duration::from_millis(200));
+        // socket is dropped without sending Node handshake
+        assert!(peer.read_handshake().is_none());
+        assert!(peer.is_closed());
+        assert!(node.connections.is_empty());
+    }
+
+    #[test]
+    fn accept_hook_gets_remote_address() {
+        let mut node = testing::node(&[]);
+        let server = testing::address(&node);
+        node.set_tcp_accept_hook(Box::new(move |address: &SocketAddr| address.ip() == server.ip()));
+        let _peer = Peer::connect(&mut node, "child", 3);
+        assert!(node.connections.contains_key("child"));
+    }
+}
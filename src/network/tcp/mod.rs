@@ -4,10 +4,14 @@ extern crate slab;
 mod main;
 mod handler;
 mod conn;
+mod socks;
+mod guard;
 
-pub use self::main::TcpNetwork;
-pub use self::handler::{TcpHandlerCMD, TcpHandlerCommand, TcpHandler};
-pub use self::conn::{TcpConnection};
+pub use self::main::{TcpNetwork, TcpAcceptHook};
+pub use self::handler::{TcpHandlerCMD, TcpHandlerCommand, TcpHandler, TcpHandlerConfig};
+pub use self::conn::{TcpConnection, MAX_HANDSHAKE_DATA_LEN};
+pub use self::socks::Socks5Proxy;
+pub use self::guard::HandshakeGuard;
 
 use self::mio::Token;
 
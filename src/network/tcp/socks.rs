@@ -0,0 +1,425 @@
+#![allow(dead_code)]
+
+use std::net::{TcpStream, SocketAddr};
+use std::io::{Read, Write, Error, ErrorKind};
+use std::io;
+use std::time::{Duration, Instant};
+
+const SOCKS_VERSION: u8 = 0x05;
+const SOCKS_AUTH_VERSION: u8 = 0x01;
+const SOCKS_METHOD_NONE: u8 = 0x00;
+const SOCKS_METHOD_PASSWORD: u8 = 0x02;
+const SOCKS_METHOD_UNACCEPTABLE: u8 = 0xFF;
+const SOCKS_CMD_CONNECT: u8 = 0x01;
+const SOCKS_ATYP_IPV4: u8 = 0x01;
+const SOCKS_ATYP_DOMAIN: u8 = 0x03;
+const SOCKS_ATYP_IPV6: u8 = 0x04;
+
+/// Default time limit for connecting to proxy and for each proxy handshake read or write
+/// proxy handshake is blocking Node thread, so it shouldn't wait forever
+/// Node is dialing only its parent during startup, before handling any connection,
+/// connections made later with "tcp_connect" are stalling Node event loop during proxy handshake
+pub const SOCKS_DEFAULT_TIMEOUT_SECS: u64 = 10;
+
+/// SOCKS5 proxy information for making client connections
+/// through a proxy server (RFC 1928, with RFC 1929 username/password auth)
+#[derive(Clone)]
+pub struct Socks5Proxy {
+    // proxy server address
+    pub address: SocketAddr,
+
+    // optional credentials, if username is empty
+    // we are asking only for "no authentication" method
+    pub username: String,
+    pub password: String,
+
+    // time limit for connecting and for each read/write during proxy handshake
+    pub timeout: Duration
+}
+
+impl Socks5Proxy {
+    #[inline(always)]
+    pub fn new(address: SocketAddr, username: String, password: String) -> Socks5Proxy {
+        Socks5Proxy {
+            address: address,
+            username: username,
+            password: password,
+            timeout: Duration::from_secs(SOCKS_DEFAULT_TIMEOUT_SECS)
+        }
+    }
+
+    /// Making blocking connection to target address over this proxy
+    /// Returns connected stream ready to be used as a regular TCP connection
+    /// for the rest of the communication (API handshake and data)
+    /// If proxy is not answering during "timeout", returns TimedOut or WouldBlock error
+    #[inline(always)]
+    pub fn connect(&self, target: &SocketAddr) -> io::Result<TcpStream> {
+        self.connect_before(target, None)
+    }
+
+    /// Same as "connect", but also giving up when "deadline" is passed
+    /// whichever step of the proxy handshake is in progress
+    pub fn connect_before(&self, target: &SocketAddr, deadline: Option<Instant>) -> io::Result<TcpStream> {
+        let mut stream = TcpStream::connect_timeout(&self.address, self.step_timeout(deadline)?)?;
+        self.negotiate_method(&mut stream, deadline)?;
+        self.request_connect(&mut stream, target, deadline)?;
+
+        // after handshake stream is used as a regular connection
+        // so removing timeouts for it
+        stream.set_read_timeout(None)?;
+        stream.set_write_timeout(None)?;
+        Ok(stream)
+    }
+
+    /// Getting time limit for the next handshake step
+    /// it's "timeout", unless there is less time left until deadline
+    fn step_timeout(&self, deadline: Option<Instant>) -> io::Result<Duration> {
+        let deadline = match deadline {
+            Some(d) => d,
+            None => return Ok(self.timeout)
+        };
+
+        let now = Instant::now();
+        if deadline <= now {
+            return Err(Error::new(ErrorKind::TimedOut, "Connect deadline passed during proxy handshake"));
+        }
+
+        Ok(if deadline - now < self.timeout { deadline - now } else { self.timeout })
+    }
+
+    /// Limiting next read and write of the proxy handshake
+    fn limit_step(&self, stream: &TcpStream, deadline: Option<Instant>) -> io::Result<()> {
+        let timeout = self.step_timeout(deadline)?;
+        stream.set_read_timeout(Some(timeout))?;
+        stream.set_write_timeout(Some(timeout))
+    }
+
+    /// Sending supported authentication methods and handling selected one
+    fn negotiate_method(&self, stream: &mut TcpStream, deadline: Option<Instant>) -> io::Result<()> {
+        self.limit_step(stream, deadline)?;
+        if self.username.len() > 0 {
+            stream.write_all(&[SOCKS_VERSION, 2, SOCKS_METHOD_NONE, SOCKS_METHOD_PASSWORD])?;
+        } else {
+            stream.write_all(&[SOCKS_VERSION, 1, SOCKS_METHOD_NONE])?;
+        }
+
+        let mut reply = [0u8; 2];
+        self.limit_step(stream, deadline)?;
+        stream.read_exact(&mut reply)?;
+        if reply[0] != SOCKS_VERSION {
+            return Err(Error::new(ErrorKind::InvalidData, "Invalid SOCKS version from proxy server"));
+        }
+
+        match reply[1] {
+            SOCKS_METHOD_NONE => Ok(()),
+            SOCKS_METHOD_PASSWORD if self.username.len() > 0 => self.authenticate(stream, deadline),
+            SOCKS_METHOD_UNACCEPTABLE => Err(Error::new(ErrorKind::PermissionDenied, "Proxy server has no acceptable authentication method")),
+            _ => Err(Error::new(ErrorKind::InvalidData, "Proxy server selected unsupported authentication method"))
+        }
+    }
+
+    /// Username/Password authentication sub-negotiation
+    fn authenticate(&self, stream: &mut TcpStream, deadline: Option<Instant>) -> io::Result<()> {
+        let (user, pass) = (self.username.as_bytes(), self.password.as_bytes());
+        if user.len() > 255 || pass.len() > 255 {
+            return Err(Error::new(ErrorKind::InvalidInput, "SOCKS username and password should be less than 256 bytes"));
+        }
+
+        let mut buffer: Vec<u8> = Vec::with_capacity(3 + user.len() + pass.len());
+        buffer.push(SOCKS_AUTH_VERSION);
+        buffer.push(user.len() as u8);
+        buffer.extend_from_slice(user);
+        buffer.push(pass.len() as u8);
+        buffer.extend_from_slice(pass);
+        self.limit_step(stream, deadline)?;
+        stream.write_all(buffer.as_slice())?;
+
+        let mut reply = [0u8; 2];
+        self.limit_step(stream, deadline)?;
+        stream.read_exact(&mut reply)?;
+        if reply[0] != SOCKS_AUTH_VERSION {
+            return Err(Error::new(ErrorKind::InvalidData, "Invalid SOCKS authentication version from proxy server"));
+        }
+
+        if reply[1] != 0 {
+            return Err(Error::new(ErrorKind::PermissionDenied, "Proxy server rejected given credentials"));
+        }
+
+        Ok(())
+    }
+
+    /// Sending CONNECT command for target address and reading proxy reply
+    fn request_connect(&self, stream: &mut TcpStream, target: &SocketAddr, deadline: Option<Instant>) -> io::Result<()> {
+        let mut buffer: Vec<u8> = vec![SOCKS_VERSION, SOCKS_CMD_CONNECT, 0];
+        match *target {
+            SocketAddr::V4(ref addr) => {
+                buffer.push(SOCKS_ATYP_IPV4);
+                buffer.extend_from_slice(&addr.ip().octets());
+            }
+
+            SocketAddr::V6(ref addr) => {
+                buffer.push(SOCKS_ATYP_IPV6);
+                buffer.extend_from_slice(&addr.ip().octets());
+            }
+        }
+        let port = target.port();
+        buffer.push((port >> 8) as u8);
+        buffer.push(port as u8);
+        self.limit_step(stream, deadline)?;
+        stream.write_all(buffer.as_slice())?;
+
+        // version, reply code, reserved, address type
+        let mut reply = [0u8; 4];
+        self.limit_step(stream, deadline)?;
+        stream.read_exact(&mut reply)?;
+        if reply[0] != SOCKS_VERSION {
+            return Err(Error::new(ErrorKind::InvalidData, "Invalid SOCKS version from proxy server"));
+        }
+
+        if reply[1] != 0 {
+            return Err(Error::new(ErrorKind::ConnectionRefused,
+                                  format!("Proxy server unable to connect, reply code {}", reply[1])));
+        }
+
+        // reading bound address and port, we don't need them
+        // but they should be consumed before actual data
+        let bound_len = match reply[3] {
+            SOCKS_ATYP_IPV4 => 4,
+            SOCKS_ATYP_IPV6 => 16,
+            SOCKS_ATYP_DOMAIN => {
+                let mut len = [0u8; 1];
+                self.limit_step(stream, deadline)?;
+                stream.read_exact(&mut len)?;
+                len[0] as usize
+            }
+            _ => return Err(Error::new(ErrorKind::InvalidData, "Unknown address type from proxy server"))
+        };
+
+        let mut bound = vec![0u8; bound_len + 2];
+        self.limit_step(stream, deadline)?;
+        stream.read_exact(bound.as_mut_slice())?;
+
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use node::testing::{self, Peer};
+    use network::Networking;
+    use event::Event;
+    use std::net::TcpListener;
+    use std::thread;
+    use std::time::Instant;
+
+    /// Minimal SOCKS5 proxy accepting one connection
+    /// if "credentials" are set, requiring username/password authentication
+    fn stub_proxy(credentials: Option<(&'static str, &'static str)>) -> SocketAddr {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let address = listener.local_addr().unwrap();
+        thread::spawn(move || {
+            let (mut client, _) = listener.accept().unwrap();
+            let mut greeting = [0u8; 2];
+            client.read_exact(&mut greeting).unwrap();
+            let mut methods = vec![0u8; greeting[1] as usize];
+            client.read_exact(methods.as_mut_slice()).unwrap();
+
+            match credentials {
+                Some((user, pass)) => {
+                    if !methods.contains(&SOCKS_METHOD_PASSWORD) {
+                        client.write_all(&[SOCKS_VERSION, SOCKS_METHOD_UNACCEPTABLE]).unwrap();
+                        return;
+                    }
+                    client.write_all(&[SOCKS_VERSION, SOCKS_METHOD_PASSWORD]).unwrap();
+
+                    let mut len = [0u8; 2];
+                    client.read_exact(&mut len).unwrap();
+                    let mut got_user = vec![0u8; len[1] as usize];
+                    client.read_exact(got_user.as_mut_slice()).unwrap();
+                    client.read_exact(&mut len[..1]).unwrap();
+                    let mut got_pass = vec![0u8; len[0] as usize];
+                    client.read_exact(got_pass.as_mut_slice()).unwrap();
+
+                    let accepted = got_user == user.as_bytes() && got_pass == pass.as_bytes();
+                    client.write_all(&[SOCKS_AUTH_VERSION, if accepted { 0 } else { 1 }]).unwrap();
+                    if !accepted {
+                        return;
+                    }
+                }
+                None => client.write_all(&[SOCKS_VERSION, SOCKS_METHOD_NONE]).unwrap()
+            }
+
+            // only IPv4 CONNECT requests are used in tests
+            let mut request = [0u8; 10];
+            client.read_exact(&mut request).unwrap();
+            assert_eq!(request[1], SOCKS_CMD_CONNECT);
+            assert_eq!(request[3], SOCKS_ATYP_IPV4);
+            let target = SocketAddr::from(([request[4], request[5], request[6], request[7]]
+                                           , ((request[8] as u16) << 8) | request[9] as u16));
+            let mut upstream = TcpStream::connect(&target).unwrap();
+            client.write_all(&[SOCKS_VERSION, 0, 0, SOCKS_ATYP_IPV4, 127, 0, 0, 1, 0, 0]).unwrap();
+
+            // relaying data in both directions
+            let mut client_read = client.try_clone().unwrap();
+            let mut upstream_write = upstream.try_clone().unwrap();
+            thread::spawn(move || { let _ = io::copy(&mut client_read, &mut upstream_write); });
+            let _ = io::copy(&mut upstream, &mut client);
+        });
+
+        address
+    }
+
+    /// Parent which reads handshake data and answers with its own
+    fn stub_parent(handshake_len: usize, reply: &'static [u8]) -> (SocketAddr, thread::JoinHandle<Vec<u8>>) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let address = listener.local_addr().unwrap();
+        let handle = thread::spawn(move || {
+            let (mut conn, _) = listener.accept().unwrap();
+            let mut handshake = vec![0u8; handshake_len];
+            conn.read_exact(handshake.as_mut_slice()).unwrap();
+            conn.write_all(reply).unwrap();
+            handshake
+        });
+
+        (address, handle)
+    }
+
+    fn handshake_through(proxy: &Socks5Proxy) {
+        let handshake: &[u8] = &[0, 0, 0, 1, 0, 0, 0, 9, b'c', 0, 0, 0, 0, 0, 0, 0, 3];
+        let reply: &'static [u8] = &[0, 0, 0, 1, 0, 0, 0, 9, b'p', 0, 0, 0, 0, 0, 0, 0, 2];
+        let (parent, handle) = stub_parent(handshake.len(), reply);
+
+        let mut stream = proxy.connect(&parent).unwrap();
+        stream.write_all(handshake).unwrap();
+        let mut got_reply = vec![0u8; reply.len()];
+        stream.read_exact(got_reply.as_mut_slice()).unwrap();
+
+        assert_eq!(handle.join().unwrap(), handshake);
+        assert_eq!(got_reply, reply);
+    }
+
+    #[test]
+    fn handshake_without_auth() {
+        let proxy = Socks5Proxy::new(stub_proxy(None), String::new(), String::new());
+        handshake_through(&proxy);
+    }
+
+    #[test]
+    fn handshake_with_auth() {
+        let proxy = Socks5Proxy::new(stub_proxy(Some(("user", "secret"))), String::from("user"), String::from("secret"));
+        handshake_through(&proxy);
+    }
+
+    #[test]
+    fn wrong_credentials() {
+        let proxy = Socks5Proxy::new(stub_proxy(Some(("user", "secret"))), String::from("user"), String::from("wrong"));
+        let target = SocketAddr::from(([127, 0, 0, 1], 1));
+        assert_eq!(proxy.connect(&target).unwrap_err().kind(), ErrorKind::PermissionDenied);
+    }
+
+    #[test]
+    fn missing_credentials() {
+        let proxy = Socks5Proxy::new(stub_proxy(Some(("user", "secret"))), String::new(), String::new());
+        let target = SocketAddr::from(([127, 0, 0, 1], 1));
+        assert_eq!(proxy.connect(&target).unwrap_err().kind(), ErrorKind::PermissionDenied);
+    }
+
+    #[test]
+    fn silent_proxy_timeout() {
+        // proxy which accepts connection, but never answers
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let address = listener.local_addr().unwrap();
+        thread::spawn(move || {
+            let _conn = listener.accept().unwrap();
+            thread::sleep(Duration::from_secs(5));
+        });
+
+        let mut proxy = Socks5Proxy::new(address, String::new(), String::new());
+        proxy.timeout = Duration::from_millis(200);
+        let started = Instant::now();
+        assert!(proxy.connect(&SocketAddr::from(([127, 0, 0, 1], 1))).is_err());
+        assert!(started.elapsed() < Duration::from_secs(2));
+    }
+
+    #[test]
+    fn silent_proxy_deadline() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let address = listener.local_addr().unwrap();
+        thread::spawn(move || {
+            let _conn = listener.accept().unwrap();
+            thread::sleep(Duration::from_secs(5));
+        });
+
+        // deadline is shorter than proxy step timeout, so it's the one giving up
+        let proxy = Socks5Proxy::new(address, String::new(), String::new());
+        let started = Instant::now();
+        let deadline = started + Duration::from_millis(200);
+        assert!(proxy.connect_before(&SocketAddr::from(([127, 0, 0, 1], 1)), Some(deadline)).is_err());
+        assert!(started.elapsed() < Duration::from_secs(2));
+    }
+
+    #[test]
+    fn passed_deadline() {
+        // giving up before connecting to proxy at all
+        let target = SocketAddr::from(([127, 0, 0, 1], 1));
+        let proxy = Socks5Proxy::new(target, String::new(), String::new());
+        let err = proxy.connect_before(&target, Some(Instant::now())).unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::TimedOut);
+    }
+
+    #[test]
+    fn auth_reply_version_checked() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let address = listener.local_addr().unwrap();
+        thread::spawn(move || {
+            let (mut client, _) = listener.accept().unwrap();
+            let mut greeting = [0u8; 4];
+            client.read_exact(&mut greeting).unwrap();
+            client.write_all(&[SOCKS_VERSION, SOCKS_METHOD_PASSWORD]).unwrap();
+            let mut auth = [0u8; 13];
+            client.read_exact(&mut auth).unwrap();
+            // success code, but with SOCKS version instead of auth sub-negotiation version
+            client.write_all(&[SOCKS_VERSION, 0]).unwrap();
+            thread::sleep(Duration::from_secs(1));
+        });
+
+        let proxy = Socks5Proxy::new(address, String::from("user"), String::from("secret"));
+        let target = SocketAddr::from(([127, 0, 0, 1], 1));
+        assert_eq!(proxy.connect(&target).unwrap_err().kind(), ErrorKind::InvalidData);
+    }
+
+    #[test]
+    fn node_connects_parent_through_proxy() {
+        let proxy = format!("{}", stub_proxy(None));
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let parent_address = format!("{}", listener.local_addr().unwrap());
+        let mut node = testing::node(&[("parent", parent_address.as_str()), ("proxy", proxy.as_str())]);
+
+        let mut parent = Peer::accept(&listener, &mut node, "parent", 7);
+        assert_eq!(node.parent_token, Some(String::from("parent")));
+        let (version, token_value) = parent.read_handshake().unwrap();
+        assert_eq!(version, node.api_version);
+        assert_eq!(&token_value[..4], b"node");
+
+        // events are going over proxy in both directions
+        let mut event = Event::default();
+        event.name = String::from("upstream");
+        event.path.mul(7);
+        node.emit(event);
+        testing::run_for(&mut node, Duration::from_millis(100));
+        assert_eq!(parent.read_event().map(|e| e.name), Some(String::from("upstream")));
+
+        let events = node.subscribe(1);
+        let mut event = Event::default();
+        event.name = String::from("downstream");
+        event.from = String::from("parent");
+        parent.send(&event);
+        let mut received = None;
+        testing::run_until(&mut node, |_| {
+            received = events.try_recv().ok();
+            received.is_some()
+        });
+        assert_eq!(received.map(|r| r.token), Some(String::from("parent")));
+    }
+}
\ No newline at end of file
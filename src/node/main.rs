@@ -7,17 +7,25 @@ use self::mio::{Poll, Events};
 use self::mio::channel::{channel, Sender, Receiver};
 use self::mio::tcp::{TcpListener};
 
-use network::{NetworkCommand, Connection
+use network::{NetworkCommand, Connection, CloseReason, ParentLossPolicy, TopologyManifest, ForwardFilter
               , TcpHandlerCommand, TcpNetwork, Networking
-              , Slab, TcpConnection, CONNECTION_COUNT_PRE_ALLOC};
+              , Slab, TcpConnection, Socks5Proxy, TcpHandlerConfig, TcpAcceptHook, HandshakeGuard
+              , CONNECTION_COUNT_PRE_ALLOC};
 use config::NodeConfig;
-use helper::Log;
-use node::{EVENT_LOOP_EVENTS_SIZE, DEFAULT_API_VERSION};
-use event::Event;
+use helper::{Log, NetHelper, HashRing, Clock, SystemClock};
+use node::{ReadyProbe, EVENT_LOOP_EVENTS_SIZE, DEFAULT_API_VERSION, EVENT_RECEIVER_CHANNEL_TOKEN};
+use event::{Event, ReceivedEvent, TappedEvent, TapDirection, EventHandler, EventCallback, EventCommand, EventMetrics, UnhandledEventPolicy, EventDedup, EventCodec, RawEventCodec, CallbackWatchdog};
 
-use std::collections::BTreeMap;
+use std::collections::{BTreeMap, VecDeque};
 use std::process;
 use std::error::Error;
+use std::sync::Arc;
+use std::sync::atomic::AtomicUsize;
+use std::time::{SystemTime, Duration};
+use std::sync::mpsc::{sync_channel, SyncSender, Receiver as SyncReceiver, TrySendError};
+
+/// Low bits of the event ID which are counting events, high bits are random nonce
+const EVENT_ID_COUNTER_MASK: u64 = 0xFFFFFFFF;
 
 pub struct Node {
     /// Node Valid information for identification
@@ -27,6 +35,25 @@ pub struct Node {
 
     /// Members for Network trait
     pub connections: BTreeMap<String, Connection>,
+    // max count of child Node and API connections, 0 means unlimited
+    pub net_max_connections: usize,
+    pub net_max_api_connections: usize,
+    // what to do with API connections when parent connection is lost
+    pub net_parent_loss_policy: ParentLossPolicy,
+    // value of the lost parent and events sent to it while it's lost with "keep" policy
+    // 0 if parent is connected or events are not buffered
+    pub net_lost_parent_value: u64,
+    pub net_parent_buffer: VecDeque<Event>,
+    pub net_parent_buffer_dropped: u64,
+    // allowed Node connections, if it's None all connections are allowed
+    pub net_manifest: Option<TopologyManifest>,
+    // filter for received events, if it's None all events are handled and forwarded
+    pub net_forward_filter: Option<ForwardFilter>,
+    // standby connection token for mirroring received events, empty if disabled
+    pub net_mirror_token: String,
+    // mirrored events count and events missed because standby was not connected
+    pub net_mirror_sent: u64,
+    pub net_mirror_missed: u64,
     pub net_sender_chan: Sender<NetworkCommand>,
     pub net_receiver_chan: Receiver<NetworkCommand>,
 
@@ -38,12 +65,75 @@ pub struct Node {
     pub net_tcp_server: TcpListener,
     // keeping just a simple TcpConnection as a pending connection
     pub net_tcp_pending_connections: Slab<TcpConnection>,
+    // callback for accepting or rejecting connections by remote address
+    // if it's None all connections are accepted
+    pub net_tcp_accept_hook: Option<TcpAcceptHook>,
+    // SOCKS5 proxy for client connections, if it's None connecting directly
+    pub net_tcp_proxy: Option<Socks5Proxy>,
+    // time limit for the whole client connect, including proxy and API handshakes
+    // None is keeping only limits of each step
+    pub net_tcp_connect_timeout: Option<Duration>,
+    // configuration for TCP handlers connections
+    pub net_tcp_handler_config: TcpHandlerConfig,
+    // failed handshakes counter for rejecting connections from blocked IPs
+    pub net_tcp_handshake_guard: HandshakeGuard,
+    // true when TCP server is registered and accepting connections
+    pub net_tcp_listening: bool,
+    // readiness shared with other threads, updated by "update_ready"
+    pub ready_probe: ReadyProbe,
 
     /// POLL service for this node thread event loop
     pub poll: Poll,
 
+    /// time source for callback timing, dedup, handshake guard and close deadlines
+    pub clock: Arc<Clock>,
+
+    /// Members for EventHandler trait
+    // callbacks with their priority, sorted from highest priority
+    pub callbacks: BTreeMap<String, Vec<(i32, EventCallback)>>,
+    // what to do with events without callbacks
+    pub event_unhandled_policy: UnhandledEventPolicy,
+    // true when policy was set while it was taken out for running fallback callback
+    pub event_unhandled_policy_changed: bool,
+    // policies for specific event names, instead of the default one
+    pub event_unhandled_policies: BTreeMap<String, UnhandledEventPolicy>,
+    pub event_sender_chan: Sender<EventCommand>,
+    pub event_receiver_chan: Receiver<EventCommand>,
+    pub event_metrics_enabled: bool,
+    pub event_metrics: BTreeMap<String, EventMetrics>,
+    // callbacks running longer than this are logged, None disables it
+    pub event_slow_threshold: Option<Duration>,
+    // tracking running callback for logging the one which is blocking Node, None disables it
+    pub event_watchdog: Option<Arc<CallbackWatchdog>>,
+
+    /// recent event IDs for dropping duplicate events
+    pub event_dedup: EventDedup,
+    // last ID used for events made by this Node
+    // it's unique only together with "from" token of the event
+    pub event_last_id: u64,
+
+    /// channels for delivering received events to subscribers
+    /// as an alternative for handling them inside "on_event_data"
+    /// with count of events dropped since subscriber channel became full
+    pub event_subscribers: Vec<(SyncSender<ReceivedEvent>, u64)>,
+    // total count of events dropped because of full subscriber channels
+    pub event_subscribers_dropped: u64,
+
+    /// channels for giving copy of every received and sent event
+    /// for auditing, taps can't change or block events
+    pub event_taps: Vec<SyncSender<TappedEvent>>,
+
     /// parent address in case if we are doing something directly from command line
-    parent_address: String
+    pub parent_address: String,
+    // token of the parent connection, None if parent is not connected
+    pub parent_token: Option<String>,
+
+    /// connections given to "on_connection_close" with their reasons, kept only for tests
+    #[cfg(test)]
+    pub closed_connections: Vec<(String, CloseReason)>,
+    /// same for "on_parent_disconnected"
+    #[cfg(test)]
+    pub lost_parents: Vec<(String, CloseReason)>
 }
 
 
@@ -51,23 +141,79 @@ impl Node {
     /// Making new node based on configurations
     pub fn new(config: &NodeConfig) -> Node {
         let (net_s, net_r) = channel::<NetworkCommand>();
+        let (event_s, event_r) = channel::<EventCommand>();
+
+        let clock: Arc<Clock> = Arc::new(SystemClock);
 
         let mut cpu_count = config.network.concurrency;
         if cpu_count == 0 {
             cpu_count = num_cpus::get();
         }
 
+        if config.token.len() > 0 && !NetHelper::validate_token(config.token.as_str(), config.network.allow_raw_tokens) {
+            Log::error("Invalid Node Token", "Token should contain only printable characters");
+            process::exit(1);
+        }
+
         Node {
             value: config.value,
             token: if config.token.len() == 0 { format!("{}", uuid::Uuid::new_v4()) } else { config.token.clone() },
             api_version: if config.api_version == 0 { DEFAULT_API_VERSION } else { config.api_version },
             connections: BTreeMap::new(),
+            net_max_connections: config.network.max_connections,
+            net_max_api_connections: config.network.max_api_connections,
+            net_parent_loss_policy: config.network.parent_loss_policy,
+            net_lost_parent_value: 0,
+            net_parent_buffer: VecDeque::new(),
+            net_parent_buffer_dropped: 0,
+            net_forward_filter: None,
+            net_mirror_token: config.network.mirror_token.clone(),
+            net_mirror_sent: 0,
+            net_mirror_missed: 0,
+            net_manifest: if config.network.manifest_path.len() == 0 { None } else {
+                match TopologyManifest::load(config.network.manifest_path.as_str()) {
+                    Ok(m) => Some(m),
+                    Err(e) => {
+                        Log::error("Invalid topology manifest", e.as_str());
+                        process::exit(1);
+                    }
+                }
+            },
             net_sender_chan: net_s,
             net_receiver_chan: net_r,
             net_tcp_handler_sender_chan: Vec::with_capacity(cpu_count),
             net_tcp_handler_index: 0,
-            net_tcp_server: Node::make_tcp_server(config.network.tcp_server_host.as_str()),
+            net_tcp_server: Node::make_tcp_server(config.network.tcp_server_host.as_str(), config.network.bind_retry),
             net_tcp_pending_connections: Slab::with_capacity(CONNECTION_COUNT_PRE_ALLOC),
+            net_tcp_accept_hook: None,
+            net_tcp_proxy: Node::make_tcp_proxy(config.network.proxy_address.as_str()
+                                                , config.network.proxy_auth.as_str()),
+            net_tcp_connect_timeout: config.network.connect_timeout,
+            net_tcp_handler_config: TcpHandlerConfig {
+                api_version: if config.api_version == 0 { DEFAULT_API_VERSION } else { config.api_version },
+                allow_raw_tokens: config.network.allow_raw_tokens,
+                trim_tokens: config.network.trim_tokens,
+                linger: config.network.linger,
+                api_linger: config.network.api_linger,
+                close_timeout: config.network.close_timeout,
+                read_timeout: config.network.read_timeout,
+                write_timeout: config.network.write_timeout,
+                read_rate: config.network.read_rate,
+                write_rate: config.network.write_rate,
+                api_read_rate: config.network.api_read_rate,
+                api_write_rate: config.network.api_write_rate,
+                codec: Arc::new(RawEventCodec),
+                close_on_decode_failure: config.network.close_on_decode_failure,
+                decode_failures: Arc::new(AtomicUsize::new(0)),
+                mirror_dropped: Arc::new(AtomicUsize::new(0)),
+                clock: clock.clone()
+            },
+            net_tcp_handshake_guard: HandshakeGuard::with_clock(config.network.handshake_failures
+                                                                , config.network.handshake_window
+                                                                , config.network.handshake_cooldown
+                                                                , clock.clone()),
+            net_tcp_listening: false,
+            ready_probe: ReadyProbe::new(),
             poll: match Poll::new() {
                 Ok(p) => p,
                 Err(e) => {
@@ -75,65 +221,186 @@ impl Node {
                     process::exit(1);
                 }
             },
-            parent_address: config.parent_address.clone()
+            clock: clock.clone(),
+            callbacks: BTreeMap::new(),
+            event_unhandled_policy: UnhandledEventPolicy::Silent,
+            event_unhandled_policy_changed: false,
+            event_unhandled_policies: BTreeMap::new(),
+            event_sender_chan: event_s,
+            event_receiver_chan: event_r,
+            event_metrics_enabled: config.event_metrics,
+            event_metrics: BTreeMap::new(),
+            event_slow_threshold: config.slow_callback,
+            event_watchdog: config.callback_watchdog.map(|limit| Arc::new(CallbackWatchdog::new(limit, clock.clone()))),
+            event_dedup: EventDedup::with_clock(config.dedup_size, config.dedup_ttl, clock),
+            event_last_id: Node::first_event_id(),
+            event_subscribers: vec![],
+            event_subscribers_dropped: 0,
+            event_taps: vec![],
+            parent_address: config.parent_address.clone(),
+            parent_token: None,
+            #[cfg(test)]
+            closed_connections: vec![],
+            #[cfg(test)]
+            lost_parents: vec![]
         }
     }
 
     /// Starting all services of Node and running event loop
     pub fn start(&mut self) {
-        // making networking available
+        self.init();
+
+        // starting base event loop
+        // making events for handling 5K events at once
+        let mut events: Events = Events::with_capacity(EVENT_LOOP_EVENTS_SIZE);
+        loop {
+            self.poll_once(&mut events, None);
+        }
+    }
+
+    /// Starting all services of Node without running event loop
+    /// and connecting to parent if it's configured
+    pub fn init(&mut self) {
+        // making networking and event handlers available
         self.init_networking();
+        self.init_event();
 
         if self.parent_address.len() > 0 {
             let address = self.parent_address.clone();
             self.tcp_connect(address.as_str());
         }
+    }
 
-        // starting base event loop
-        // making events for handling 5K events at once
-        let mut events: Events = Events::with_capacity(EVENT_LOOP_EVENTS_SIZE);
-        loop {
-            let event_count = self.poll.poll(&mut events, None).unwrap();
-            if event_count == 0 {
+    /// Running single cycle of event loop
+    /// waiting for events not longer than given timeout, None is waiting forever
+    pub fn poll_once(&mut self, events: &mut Events, timeout: Option<Duration>) {
+        let event_count = self.poll.poll(events, timeout).unwrap();
+        if event_count == 0 {
+            return;
+        }
+
+        for event in events.iter() {
+            let (token, kind) = (event.token(), event.kind());
+
+            if token == EVENT_RECEIVER_CHANNEL_TOKEN {
+                self.event_notify();
                 continue;
             }
 
-            for event in events.iter() {
-                let (token, kind) = (event.token(), event.kind());
+            // if this is a networking event just moving to the next event
+            // otherwise we will probably check other block implementations
+//            if self.net_ready(token, kind) {
+//                continue;
+//            }
+            self.net_ready(token, kind);
+        }
+    }
 
-                // if this is a networking event just moving to the next event
-                // otherwise we will probably check other block implementations
-//                if self.net_ready(token, kind) {
-//                    continue;
-//                }
-                self.net_ready(token, kind);
+    /// Loading topology manifest again from given file
+    /// already accepted connections are not checked again
+    /// If file is invalid, keeping current manifest and returning false
+    pub fn reload_manifest(&mut self, path: &str) -> bool {
+        match TopologyManifest::load(path) {
+            Ok(m) => {
+                self.net_manifest = Some(m);
+                true
+            }
+            Err(e) => {
+                Log::error("Unable to reload topology manifest", e.as_str());
+                false
             }
         }
     }
 
+    /// Stable identity hash of this Node, based on token and given salt
+    #[inline(always)]
+    pub fn node_id(&self, salt: &str) -> u64 {
+        HashRing::node_id(self.token.as_str(), salt)
+    }
+
+    /// Making consistent hash ring of the connected Nodes except parent and mirror standby
+    /// for distributing keys over children
+    pub fn children_ring(&self, replicas: usize) -> HashRing {
+        let mut ring = HashRing::new(replicas);
+        for (token, conn) in &self.connections {
+            if conn.value == 0 || self.parent_token.as_ref() == Some(token) || token == &self.net_mirror_token {
+                continue;
+            }
+
+            ring.add(token.as_str());
+        }
+
+        ring
+    }
+
+    /// Checking if Node is configured without parent
+    /// This is not changing when parent connection is lost
+    #[inline(always)]
+    pub fn is_root(&self) -> bool {
+        self.parent_address.len() == 0
+    }
+
+    /// Checking if Node is ready for work
+    /// Node is ready when TCP server is listening and parent is connected
+    /// if Node doesn't have a parent, then only listening is required
+    pub fn is_ready(&self) -> bool {
+        self.net_tcp_listening && (self.is_root() || self.parent_token.is_some())
+    }
+
+    /// Getting readiness which could be checked or waited from other threads
+    /// because Node itself is owned by event loop thread after start
+    #[inline(always)]
+    pub fn ready_probe(&self) -> ReadyProbe {
+        self.ready_probe.clone()
+    }
+
+    /// Giving current readiness to the probe
+    /// should be called after listening or parent connection state changes
+    #[inline(always)]
+    pub fn update_ready(&self) {
+        self.ready_probe.set(self.is_ready());
+    }
+
     /// Handling new connection here
     pub fn on_new_connection(&mut self, token: &String, value: u64) {
-        println!("Got New Connection -> {} {}", token, value);
+        println!("Got New Connection -> {} {}", NetHelper::escape_token(token), value);
     }
 
     /// Handling new API connection here
     pub fn on_new_api_connection(&mut self, token: &String) {
-        println!("Got New API Connection -> {}", token);
+        println!("Got New API Connection -> {}", NetHelper::escape_token(token));
     }
 
     /// Handling new identity/channel from existing connection
     pub fn on_new_connection_channel(&mut self, token: &String) {
-        println!("Got New Connection Channel -> {}", token);
+        println!("Got New Connection Channel -> {}", NetHelper::escape_token(token));
     }
 
     /// Handling Connection Close Functionality
-    pub fn on_connection_close(&mut self, token: &String) {
-        println!("Connection Closed -> {}", token);
+    /// "reason" is the reason of closing last channel
+    /// connection is still in connections list here, so its traffic totals are available
+    pub fn on_connection_close(&mut self, token: &String, reason: &CloseReason) {
+        let (read, written) = match self.connections.get(token) {
+            Some(conn) => (conn.bytes_read, conn.bytes_written),
+            None => (0, 0)
+        };
+        println!("Connection Closed -> {} -> {} ({} bytes read, {} bytes written)", NetHelper::escape_token(token), reason, read, written);
+        #[cfg(test)]
+        self.closed_connections.push((token.clone(), reason.clone()));
     }
 
-    /// Handling Connection Close Functionality
-    pub fn on_connection_channel_close(&mut self, token: &String) {
-        println!("Connection Channel Closed -> {}", token);
+    /// Handling parent connection close, called after "on_connection_close"
+    /// Never called for root Node
+    pub fn on_parent_disconnected(&mut self, token: &String, reason: &CloseReason) {
+        println!("Parent Connection Closed -> {} -> {}", NetHelper::escape_token(token), reason);
+        #[cfg(test)]
+        self.lost_parents.push((token.clone(), reason.clone()));
+    }
+
+    /// Handling Connection Channel Close Functionality
+    /// "reason" is the reason of closing this channel
+    pub fn on_connection_channel_close(&mut self, token: &String, reason: &CloseReason) {
+        println!("Connection Channel Closed -> {} -> {}", NetHelper::escape_token(token), reason);
     }
 
     /// Handling data/event from connection
@@ -142,6 +409,355 @@ impl Node {
     #[inline(always)]
     pub fn on_event_data(&mut self, token: &String, event: &Event) -> bool {
 //        println!("Got data from connection -> {} -> {}", token, event.from);
+        // running callbacks registered for this event name
+        self.trigger(event);
         true
     }
-}
\ No newline at end of file
+
+    /// Making next unique ID for event sending from this Node
+    #[inline(always)]
+    pub fn make_event_id(&mut self) -> u64 {
+        self.event_last_id += 1;
+        // counter part is over, so continuing with a new nonce
+        if self.event_last_id & EVENT_ID_COUNTER_MASK == 0 {
+            self.event_last_id = Node::first_event_id() + 1;
+        }
+        self.event_last_id
+    }
+
+    /// IDs are starting with random per process nonce in high 32 bits and counter in low 32 bits,
+    /// so restarted Node wouldn't reuse IDs which other Nodes are still keeping for dropping duplicates,
+    /// even if system clock went backwards
+    fn first_event_id() -> u64 {
+        let bytes = uuid::Uuid::new_v4();
+        let (_, nonce) = NetHelper::bytes_to_u32(&Vec::from(&bytes.as_bytes()[..4]), 0);
+        (nonce as u64) << 32
+    }
+
+    /// Setting codec for encoding and decoding events
+    /// should be called before starting Node, because TcpHandlers are getting
+    /// copy of the configuration when they are starting
+    pub fn set_event_codec(&mut self, codec: Arc<EventCodec>) {
+        self.net_tcp_handler_config.codec = codec;
+    }
+
+    /// Making channel for receiving events from connections
+    /// If subscriber is slower than incoming events and channel buffer is full
+    /// event would be dropped for this subscriber, instead of blocking Node event loop
+    pub fn subscribe(&mut self, capacity: usize) -> SyncReceiver<ReceivedEvent> {
+        let (s, r) = sync_channel::<ReceivedEvent>(capacity);
+        self.event_subscribers.push((s, 0));
+        r
+    }
+
+    /// Sending copy of received event to all subscribers
+    /// removing subscribers which are not receiving anymore
+    /// full subscriber is logged only once, when it starts dropping events
+    pub fn deliver_event(&mut self, token: &String, event: &Event) {
+        if self.event_subscribers.len() == 0 {
+            return;
+        }
+
+        let mut i = 0;
+        while i < self.event_subscribers.len() {
+            let received = ReceivedEvent {
+                token: token.clone(),
+                event: event.clone()
+            };
+
+            let (ref chan, ref mut dropped) = self.event_subscribers[i];
+            match chan.try_send(received) {
+                Ok(_) => {
+                    if *dropped > 0 {
+                        Log::info("Event subscriber is receiving again", format!("{} events were dropped", dropped).as_str());
+                        *dropped = 0;
+                    }
+                },
+                Err(TrySendError::Full(_)) => {
+                    if *dropped == 0 {
+                        Log::warn("Event subscriber channel is full, dropping events", event.name.as_str());
+                    }
+                    *dropped += 1;
+                    self.event_subscribers_dropped += 1;
+                }
+                Err(TrySendError::Disconnected(_)) => {
+                    self.event_subscribers.remove(i);
+                    continue;
+                }
+            }
+
+            i += 1;
+        }
+    }
+
+    /// Making channel for getting copy of every received and sent event
+    /// Same as subscribers, slow tap would miss events instead of blocking Node event loop
+    pub fn tap(&mut self, capacity: usize) -> SyncReceiver<TappedEvent> {
+        let (s, r) = sync_channel::<TappedEvent>(capacity);
+        self.event_taps.push(s);
+        r
+    }
+
+    /// Sending copy of event to all taps
+    /// removing taps which are not receiving anymore
+    pub fn tap_event(&mut self, direction: TapDirection, tokens: &Vec<String>, event: &Event) {
+        if self.event_taps.len() == 0 {
+            return;
+        }
+
+        let time = SystemTime::now();
+        let mut i = 0;
+        while i < self.event_taps.len() {
+            let tapped = TappedEvent {
+                direction: direction,
+                time: time,
+                tokens: tokens.clone(),
+                event: event.clone()
+            };
+
+            match self.event_taps[i].try_send(tapped) {
+                Ok(_) => {},
+                Err(TrySendError::Full(_)) => {
+                    Log::warn("Event tap channel is full, dropping event", event.name.as_str());
+                }
+                Err(TrySendError::Disconnected(_)) => {
+                    self.event_taps.remove(i);
+                    continue;
+                }
+            }
+
+            i += 1;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use node::testing::{self, Peer};
+    use network::{Networking, CONNECTION_CLOSE_EVENT, CONNECTION_CAPACITY_REASON};
+    use std::rc::Rc;
+    use std::cell::Cell;
+    use std::net::{TcpListener, Shutdown};
+    use std::thread;
+
+    fn event(name: &str, from: &str, data: Vec<u8>) -> Event {
+        let mut ev = Event::default();
+        ev.name = String::from(name);
+        ev.from = String::from(from);
+        ev.data = data;
+        ev
+    }
+
+    #[test]
+    fn subscriber_gets_events_in_order() {
+        let mut node = testing::node(&[]);
+        let events = node.subscribe(10);
+        let mut child = Peer::connect(&mut node, "child", 3);
+        for i in 0..3 {
+            child.send(&event("update", "child-node", vec![i]));
+        }
+
+        let mut received = vec![];
+        testing::run_until(&mut node, |_| {
+            while let Ok(r) = events.try_recv() {
+                received.push(r);
+            }
+            received.len() == 3
+        });
+        for (i, r) in received.iter().enumerate() {
+            assert_eq!(r.token, "child");
+            assert_eq!(r.event.name, "update");
+            assert_eq!(r.event.from, "child-node");
+            assert_eq!(r.event.data, vec![i as u8]);
+        }
+    }
+
+    #[test]
+    fn full_subscriber_drops_events() {
+        let mut node = testing::node(&[]);
+        let events = node.subscribe(1);
+        let token = String::from("child");
+
+        // only first event fits into channel, others are dropped with a single warning
+        let lines = Log::capture(|| {
+            for i in 0..4 {
+                node.deliver_event(&token, &event("update", "child", vec![i]));
+            }
+        });
+        assert_eq!(lines, vec![String::from("[WARNING] Event subscriber channel is full, dropping events -> update")]);
+        assert_eq!(node.event_subscribers_dropped, 3);
+        assert_eq!(events.try_recv().unwrap().event.data, vec![0]);
+
+        let lines = Log::capture(|| node.deliver_event(&token, &event("update", "child", vec![9])));
+        assert_eq!(lines, vec![String::from("[INFO] Event subscriber is receiving again -> 3 events were dropped")]);
+        assert_eq!(events.try_recv().unwrap().event.data, vec![9]);
+    }
+
+    #[test]
+    fn closed_subscriber_removed() {
+        let mut node = testing::node(&[]);
+        let events = node.subscribe(1);
+        drop(events);
+
+        node.deliver_event(&String::from("child"), &event("update", "child", vec![]));
+        assert!(node.event_subscribers.is_empty());
+    }
+
+    /// Getting all tapped events available right now
+    fn tapped(taps: &SyncReceiver<TappedEvent>) -> Vec<(TapDirection, Vec<String>, String)> {
+        let mut events = vec![];
+        while let Ok(t) = taps.try_recv() {
+            events.push((t.direction, t.tokens, t.event.name));
+        }
+        events
+    }
+
+    #[test]
+    fn taps_see_both_directions() {
+        let mut node = testing::node(&[]);
+        let taps = vec![node.tap(10), node.tap(10)];
+        let mut child = Peer::connect(&mut node, "child", 3);
+
+        let handled = Rc::new(Cell::new(false));
+        let callback_handled = handled.clone();
+        node.on("request", Box::new(move |_: &Event, _: &mut Node| {
+            callback_handled.set(true);
+            true
+        }));
+        child.send(&event("request", "child", vec![1]));
+        testing::run_until(&mut node, |_| handled.get());
+
+        let mut reply = event("reply", "node", vec![2]);
+        reply.path.mul(3);
+        node.emit(reply);
+        assert_eq!(child.read_event().unwrap().name, "reply");
+
+        for t in &taps {
+            assert_eq!(tapped(t), vec![(TapDirection::Inbound, vec![String::from("child")], String::from("request")),
+                                       (TapDirection::Outbound, vec![String::from("child")], String::from("reply"))]);
+        }
+    }
+
+    #[test]
+    fn taps_see_close_events() {
+        let mut node = testing::node(&[("max_connections", "1")]);
+        let taps = node.tap(10);
+        let mut child = Peer::connect(&mut node, "child", 3);
+
+        // connection over limit is getting close event before it's rejected
+        let mut rejected = Peer::connect_raw(&node, "rejected", 5);
+        testing::run_for(&mut node, Duration::from_millis(200));
+        rejected.read_handshake();
+        assert_eq!(rejected.read_close(), Some(String::from(CONNECTION_CAPACITY_REASON)));
+
+        assert!(node.disconnect(&String::from("child"), "evicted").is_ok());
+        assert_eq!(child.read_close(), Some(String::from("evicted")));
+
+        // API connection is not limited by "max_connections"
+        let mut other = Peer::connect(&mut node, "other", 0);
+        let mut goodbye = event(CONNECTION_CLOSE_EVENT, "other", Vec::from("bye".as_bytes()));
+        goodbye.target = String::from("node");
+        other.send(&goodbye);
+        testing::run_until(&mut node, |n| n.connections.get("other").map_or(false, |c| c.remote_close_reason.is_some()));
+
+        assert_eq!(tapped(&taps), vec![(TapDirection::Outbound, vec![String::from("rejected")], String::from(CONNECTION_CLOSE_EVENT)),
+                                       (TapDirection::Outbound, vec![String::from("child")], String::from(CONNECTION_CLOSE_EVENT)),
+                                       (TapDirection::Inbound, vec![String::from("other")], String::from(CONNECTION_CLOSE_EVENT))]);
+    }
+
+    #[test]
+    fn root_ready_when_listening() {
+        let node = Node::new(&testing::config(&[]));
+        let probe = node.ready_probe();
+        assert!(node.is_root() && !node.is_ready() && !probe.is_ready());
+
+        let mut node = node;
+        node.init();
+        assert!(node.is_ready() && probe.is_ready());
+    }
+
+    #[test]
+    fn child_ready_while_parent_connected() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let parent_address = format!("{}", listener.local_addr().unwrap());
+        let mut node = testing::node(&[("parent", parent_address.as_str())]);
+        let probe = node.ready_probe();
+        assert!(!node.is_root() && !probe.is_ready());
+
+        // readiness is waited from other thread, while Node is running
+        let waiting = probe.clone();
+        let waiter = thread::spawn(move || waiting.wait_ready(Duration::from_secs(5)));
+        let parent = Peer::accept(&listener, &mut node, "parent", 3);
+        assert!(waiter.join().unwrap());
+        assert!(node.is_ready());
+
+        drop(parent);
+        testing::run_until(&mut node, |n| n.parent_token.is_none());
+        assert!(!node.is_ready() && !probe.is_ready());
+        assert!(!probe.wait_ready(Duration::from_millis(10)));
+    }
+
+    #[test]
+    fn root_has_no_parent_to_lose() {
+        let mut node = testing::node(&[]);
+        let child = Peer::connect(&mut node, "child", 3);
+        assert!(node.is_root());
+        assert!(node.parent_token.is_none());
+
+        drop(child);
+        testing::run_until(&mut node, |n| !n.closed_connections.is_empty());
+        assert!(node.lost_parents.is_empty());
+        assert!(node.is_root());
+    }
+
+    #[test]
+    fn child_loses_parent() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let parent_address = format!("{}", listener.local_addr().unwrap());
+        let mut node = testing::node(&[("parent", parent_address.as_str())]);
+        let mut parent = Peer::accept(&listener, &mut node, "parent", 3);
+        let _child = Peer::connect(&mut node, "child", 5);
+        assert!(!node.is_root());
+
+        parent.read_handshake();
+        let mut goodbye = event(CONNECTION_CLOSE_EVENT, "parent", Vec::from("restarting".as_bytes()));
+        goodbye.target = String::from("node");
+        parent.send(&goodbye);
+        parent.stream.shutdown(Shutdown::Write).unwrap();
+        testing::run_until(&mut node, |n| !n.lost_parents.is_empty());
+
+        // close is reported as usual before parent loss
+        let reason = CloseReason::Remote(String::from("restarting"));
+        assert_eq!(node.closed_connections, vec![(String::from("parent"), reason.clone())]);
+        assert_eq!(node.lost_parents, vec![(String::from("parent"), reason)]);
+        assert!(node.parent_token.is_none() && !node.is_root());
+        assert!(node.connections.contains_key("child"));
+    }
+
+    #[test]
+    fn restarted_node_ids_not_dropped_as_duplicates() {
+        let mut receiver = testing::node(&[("dedup_size", "10")]);
+        let mut node = testing::node(&[("token", "child")]);
+        let first = node.make_event_id();
+        assert_eq!(first & EVENT_ID_COUNTER_MASK, 1);
+        assert!(receiver.event_dedup.check(&node.token, first));
+
+        // same token after restart is getting new nonce, so its IDs are not the same as before
+        let mut restarted = testing::node(&[("token", "child")]);
+        let id = restarted.make_event_id();
+        assert!(id >> 32 != first >> 32);
+        assert!(receiver.event_dedup.check(&restarted.token, id));
+        assert!(!receiver.event_dedup.check(&restarted.token, id));
+    }
+
+    #[test]
+    fn event_id_counter_overflow_takes_new_nonce() {
+        let mut node = testing::node(&[]);
+        let nonce = node.event_last_id >> 32;
+        node.event_last_id = (nonce << 32) | EVENT_ID_COUNTER_MASK;
+        let id = node.make_event_id();
+        assert_eq!(id & EVENT_ID_COUNTER_MASK, 1);
+        assert!(id >> 32 != nonce);
+    }
+}
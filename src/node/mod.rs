@@ -2,8 +2,12 @@
 
 extern crate mio;
 mod main;
+mod ready;
+#[cfg(test)]
+pub mod testing;
 
 pub use self::main::Node;
+pub use self::ready::ReadyProbe;
 
 
 use self::mio::Token;
@@ -11,6 +15,8 @@ use std::u32::MAX as u32MAX;
 
 pub const NET_RECEIVER_CHANNEL_TOKEN: Token = Token((u32MAX - 1) as usize);
 pub const NET_TCP_SERVER_TOKEN: Token = Token((u32MAX - 2) as usize);
+pub const EVENT_RECEIVER_CHANNEL_TOKEN: Token = Token((u32MAX - 3) as usize);
 
 pub const EVENT_LOOP_EVENTS_SIZE: usize = 65000;
-pub const DEFAULT_API_VERSION: u32 = 1;
\ No newline at end of file
+/// Version 2 is adding schema version and id to events and framing them outside of raw format
+pub const DEFAULT_API_VERSION: u32 = 2;
\ No newline at end of file
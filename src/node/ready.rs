@@ -0,0 +1,71 @@
+#![allow(dead_code)]
+
+use std::sync::{Arc, Mutex, Condvar};
+use std::time::{Duration, Instant};
+
+/// Readiness of the Node which could be checked from other threads
+/// while Node event loop is running, for example by readiness probe
+/// Node is updating it every time when listening or parent connection state changes
+#[derive(Clone)]
+pub struct ReadyProbe {
+    state: Arc<(Mutex<bool>, Condvar)>
+}
+
+impl ReadyProbe {
+    pub fn new() -> ReadyProbe {
+        ReadyProbe {
+            state: Arc::new((Mutex::new(false), Condvar::new()))
+        }
+    }
+
+    /// Setting current readiness and waking up waiting threads
+    pub fn set(&self, ready: bool) {
+        let &(ref lock, ref cvar) = &*self.state;
+        *lock.lock().unwrap() = ready;
+        cvar.notify_all();
+    }
+
+    /// Checking if Node is ready right now
+    pub fn is_ready(&self) -> bool {
+        *self.state.0.lock().unwrap()
+    }
+
+    /// Waiting until Node is ready, but not longer than given timeout
+    /// Returns false if Node is still not ready after timeout
+    pub fn wait_ready(&self, timeout: Duration) -> bool {
+        let &(ref lock, ref cvar) = &*self.state;
+        let deadline = Instant::now() + timeout;
+        let mut ready = lock.lock().unwrap();
+        while !*ready {
+            let now = Instant::now();
+            if now >= deadline {
+                return false;
+            }
+
+            ready = cvar.wait_timeout(ready, deadline - now).unwrap().0;
+        }
+
+        true
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::thread;
+
+    #[test]
+    fn wait_until_ready() {
+        let probe = ReadyProbe::new();
+        assert!(!probe.wait_ready(Duration::from_millis(10)));
+
+        let waiting = probe.clone();
+        let waiter = thread::spawn(move || waiting.wait_ready(Duration::from_secs(5)));
+        probe.set(true);
+        assert!(waiter.join().unwrap());
+        assert!(probe.is_ready());
+
+        probe.set(false);
+        assert!(!probe.is_ready());
+    }
+}
@@ -0,0 +1,178 @@
+#![allow(dead_code)]
+extern crate mio;
+
+use self::mio::Events;
+
+use node::Node;
+use config::NodeConfig;
+use event::{Event, RawEventCodec};
+use helper::NetHelper;
+use network::CONNECTION_CLOSE_EVENT;
+
+use std::collections::BTreeMap;
+use std::net::{SocketAddr, TcpStream, TcpListener};
+use std::io::{Read, Write};
+use std::time::{Duration, Instant};
+
+/// How long tests are waiting for Node or other side of connection
+const WAIT_TIMEOUT_SECS: u64 = 5;
+
+/// Making Node configuration from given values on top of the test defaults
+/// test Node is listening on a random local port with a single TCP handler
+pub fn config(values: &[(&str, &str)]) -> NodeConfig {
+    let mut all: BTreeMap<String, String> = BTreeMap::new();
+    all.insert(String::from("token"), String::from("node"));
+    all.insert(String::from("value"), String::from("2"));
+    all.insert(String::from("tcp_host"), String::from("127.0.0.1:0"));
+    all.insert(String::from("concurrency"), String::from("1"));
+    for &(k, v) in values {
+        all.insert(String::from(k), String::from(v));
+    }
+
+    match NodeConfig::from_values(&all) {
+        Ok(c) => c,
+        Err(problems) => panic!("invalid test configuration {:?}", problems)
+    }
+}
+
+/// Making started Node with given configuration values
+/// event loop is not running, it should be moved by "run_until"
+pub fn node(values: &[(&str, &str)]) -> Node {
+    let mut node = Node::new(&config(values));
+    node.init();
+    node
+}
+
+/// Getting address of the TCP server of given Node
+pub fn address(node: &Node) -> SocketAddr {
+    node.net_tcp_server.local_addr().unwrap()
+}
+
+/// Running Node event loop until given condition is true
+pub fn run_until<F>(node: &mut Node, mut done: F) where F: FnMut(&mut Node) -> bool {
+    let mut events = Events::with_capacity(1024);
+    let started = Instant::now();
+    while !done(node) {
+        if started.elapsed() > Duration::from_secs(WAIT_TIMEOUT_SECS) {
+            panic!("Node didn't reach expected state in time");
+        }
+        node.poll_once(&mut events, Some(Duration::from_millis(10)));
+    }
+}
+
+/// Running Node event loop during given time
+pub fn run_for(node: &mut Node, duration: Duration) {
+    let started = Instant::now();
+    run_until(node, |_| started.elapsed() >= duration);
+}
+
+/// Other side of the Node connection, talking raw protocol over blocking socket
+pub struct Peer {
+    pub stream: TcpStream,
+    pub token: String
+}
+
+impl Peer {
+    /// Connecting to given Node and sending handshake without waiting for Node to accept it
+    pub fn connect_raw(node: &Node, token: &str, value: u64) -> Peer {
+        Peer::handshake(TcpStream::connect(address(node)).unwrap(), node.api_version, token, value)
+    }
+
+    /// Accepting connection which given Node made to this side as to its parent
+    /// and sending handshake, Node handshake is not read yet
+    pub fn accept(listener: &TcpListener, node: &mut Node, token: &str, value: u64) -> Peer {
+        let (stream, _) = listener.accept().unwrap();
+        let peer = Peer::handshake(stream, node.api_version, token, value);
+        let token_str = String::from(token);
+        run_until(node, |n| n.connections.contains_key(&token_str));
+        peer
+    }
+
+    /// Sending API version, Token and Value over given stream
+    fn handshake(stream: TcpStream, api_version: u32, token: &str, value: u64) -> Peer {
+        stream.set_read_timeout(Some(Duration::from_secs(WAIT_TIMEOUT_SECS))).unwrap();
+
+        let mut data = vec![0; 4 + 4 + token.len() + 8];
+        let mut offset = NetHelper::u32_to_bytes(api_version, &mut data, 0);
+        offset += NetHelper::u32_to_bytes((token.len() + 8) as u32, &mut data, offset);
+        data[offset..offset + token.len()].copy_from_slice(token.as_bytes());
+        offset += token.len();
+        NetHelper::u64_to_bytes(value, &mut data, offset);
+
+        let mut peer = Peer {
+            stream: stream,
+            token: String::from(token)
+        };
+        peer.stream.write_all(data.as_slice()).unwrap();
+        peer
+    }
+
+    /// Connecting to given Node and waiting until Node accepts this connection
+    /// Node handshake is read, so next data is events
+    pub fn connect(node: &mut Node, token: &str, value: u64) -> Peer {
+        let mut peer = Peer::connect_raw(node, token, value);
+        let token_str = String::from(token);
+        run_until(node, |n| n.connections.contains_key(&token_str));
+        peer.read_handshake();
+        peer
+    }
+
+    /// Reading Node API version, Token and Value
+    pub fn read_handshake(&mut self) -> Option<(u32, Vec<u8>)> {
+        let mut version = vec![0; 4];
+        if self.stream.read_exact(&mut version).is_err() {
+            return None;
+        }
+
+        let (_, version) = NetHelper::bytes_to_u32(&version, 0);
+        self.read_frame().map(|data| (version, data))
+    }
+
+    /// Reading single length framed chunk, None if connection is closed or nothing came in time
+    pub fn read_frame(&mut self) -> Option<Vec<u8>> {
+        let mut length = vec![0; 4];
+        if self.stream.read_exact(&mut length).is_err() {
+            return None;
+        }
+
+        let (_, length) = NetHelper::bytes_to_u32(&length, 0);
+        let mut data = vec![0; length as usize];
+        if self.stream.read_exact(&mut data).is_err() {
+            return None;
+        }
+
+        Some(data)
+    }
+
+    /// Reading next event sent by Node
+    pub fn read_event(&mut self) -> Option<Event> {
+        self.read_frame().and_then(|data| Event::from_raw(&data))
+    }
+
+    /// Reading events until close event, returning its reason
+    pub fn read_close(&mut self) -> Option<String> {
+        while let Some(event) = self.read_event() {
+            if event.name == CONNECTION_CLOSE_EVENT {
+                return Some(String::from_utf8_lossy(event.data.as_slice()).into_owned());
+            }
+        }
+        None
+    }
+
+    /// Checking that Node closed its side of connection
+    pub fn is_closed(&mut self) -> bool {
+        let mut buf = [0; 1024];
+        loop {
+            match self.stream.read(&mut buf) {
+                Ok(0) => return true,
+                Ok(_) => continue,
+                Err(_) => return false
+            }
+        }
+    }
+
+    /// Sending event to Node
+    pub fn send(&mut self, event: &Event) {
+        event.write_to(&RawEventCodec, &mut self.stream).unwrap();
+    }
+}